@@ -1,12 +1,16 @@
 package app
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/chrisolsen/ae/handler"
 	"github.com/chrisolsen/aetemplate/core"
 	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
 )
 
 type AccountsHandler struct {
@@ -18,20 +22,114 @@ func (h AccountsHandler) ServeHTTP(c context.Context, w http.ResponseWriter, r *
 	switch r.Method {
 	case http.MethodGet:
 		h.getMe()
+	case http.MethodPatch:
+		h.patchMe()
+	case http.MethodDelete:
+		h.deleteMe()
 	case http.MethodOptions:
 		h.ValidateOrigin(nil)
 	default:
-		h.Abort(http.StatusNotFound, nil)
+		abort(&h.Base, errRouteNotFound)
 	}
 }
 
+// getMe returns the signed in account along with the ETag of its version
+//
+// 	GET /v1/me => [200, 401]
 func (h *AccountsHandler) getMe() {
-	var me core.Account
-	err := session.Account(h.Ctx, &me)
+	me, err := storedAccount(h.Ctx)
 	if err != nil {
-		h.Abort(http.StatusBadRequest, fmt.Errorf("unable to get account from token: %v", err))
+		abort(&h.Base, errSessionAccount(err))
 		return
 	}
 
-	h.ToJSON(&me)
+	h.Res.Header().Set("ETag", accountETag(me.Version))
+	h.ToJSON(me)
+}
+
+// patchMe applies the JSON merge patch to the signed in account; only the
+// names, gender, locale, location, timezone and email can be changed. When the
+// If-Match header is set the update is rejected if the account has changed
+// since the ETag was returned. Email changes must be verified again.
+//
+// 	PATCH /v1/me => [200, 400, 401, 409, 412, 500]
+// 	If-Match: "3"
+// 	{
+// 		"locale": "en-CA",
+// 		"location": null
+// 	}
+func (h *AccountsHandler) patchMe() {
+	accountKey, err := session.AccountKey(h.Ctx)
+	if err != nil {
+		abort(&h.Base, errSessionAccount(err))
+		return
+	}
+
+	version, err := ifMatchVersion(h.Req)
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	var patch map[string]json.RawMessage
+	err = json.NewDecoder(h.Req.Body).Decode(&patch)
+	if err != nil || patch == nil {
+		abort(&h.Base, errInvalidBody(err))
+		return
+	}
+
+	account, err := AccountStore.Patch(h.Ctx, accountKey, version, patch)
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	if _, ok := patch["email"]; ok && account.EmailVerified.IsZero() {
+		// a failed email shouldn't fail the update; it can be resent
+		err = newEmailVerifier().Start(h.Ctx, accountKey)
+		if err != nil {
+			log.Errorf(h.Ctx, "sending verification email: %v", err)
+		}
+	}
+
+	h.Res.Header().Set("ETag", accountETag(account.Version))
+	h.ToJSON(account)
+}
+
+// deleteMe soft deletes the signed in account and signs out all of its tokens.
+// The account is purged once the grace period ends, unless it is restored with
+// the emailed code.
+//
+// 	DELETE /v1/me => [202, 401, 500]
+func (h *AccountsHandler) deleteMe() {
+	accountKey, err := session.AccountKey(h.Ctx)
+	if err != nil {
+		abort(&h.Base, errSessionAccount(err))
+		return
+	}
+
+	scheduleDeletion(&h.Base, accountKey)
+}
+
+// accountETag returns the ETag of the account version
+func accountETag(version int64) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// ifMatchVersion returns the account version within the If-Match header, or -1
+// if any version matches. Tags that weren't returned by accountETag can't match.
+func ifMatchVersion(r *http.Request) (int64, error) {
+	match := strings.TrimSpace(r.Header.Get("If-Match"))
+	if len(match) == 0 || match == "*" {
+		return -1, nil
+	}
+
+	if len(match) < 2 || !strings.HasPrefix(match, `"`) || !strings.HasSuffix(match, `"`) {
+		return 0, core.ErrStaleAccount
+	}
+	version, err := strconv.ParseInt(match[1:len(match)-1], 10, 64)
+	if err != nil {
+		return 0, core.ErrStaleAccount
+	}
+	return version, nil
 }
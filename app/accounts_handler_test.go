@@ -0,0 +1,51 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/chrisolsen/aetemplate/core"
+)
+
+func TestAccountsHandler_PatchAfterGet(t *testing.T) {
+	c := getContext()
+	accountKey, err := AccountStore.Create(c, &core.Credentials{Username: "etag", Password: "foobario"}, &core.Account{Name: "etag"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = session.SetAccountKey(c, accountKey)
+
+	serve := func(method, body, ifMatch string) *httptest.ResponseRecorder {
+		r, err := http.NewRequest(method, "/v1/me", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ifMatch) > 0 {
+			r.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		AccountsHandler{}.ServeHTTP(c, w, r)
+		return w
+	}
+
+	w := serve(http.MethodGet, "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected account, got %d: %s", w.Code, w.Body)
+	}
+	w = serve(http.MethodPatch, `{"locale": "en-CA"}`, w.Header().Get("ETag"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected patch to succeed, got %d: %s", w.Code, w.Body)
+	}
+
+	// the ETag must reflect the patch, or the next conditional patch fails
+	w = serve(http.MethodGet, "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected account, got %d: %s", w.Code, w.Body)
+	}
+	w = serve(http.MethodPatch, `{"location": "Edmonton"}`, w.Header().Get("ETag"))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected patch with the latest ETag to succeed, got %d: %s", w.Code, w.Body)
+	}
+}
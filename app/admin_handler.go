@@ -0,0 +1,181 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chrisolsen/ae/handler"
+	"github.com/chrisolsen/aetemplate/core"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// maxAccountEstimate bounds the accounts counted for the total estimate
+const maxAccountEstimate = 10000
+
+const adminAccountsPath = "/v1/admin/accounts"
+
+var errAccountNotFound = core.NewError(core.NotFound, "account_not_found", "account not found")
+
+// AdminAccountsHandler lists accounts for admins
+type AdminAccountsHandler struct {
+	handler.Base
+}
+
+func (h AdminAccountsHandler) ServeHTTP(c context.Context, w http.ResponseWriter, r *http.Request) {
+	h.Bind(c, w, r)
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == adminAccountsPath:
+		h.list()
+	case r.Method == http.MethodDelete:
+		h.delete()
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/restore"):
+		h.restore()
+	case r.Method == http.MethodOptions:
+		h.ValidateOrigin(nil)
+	default:
+		abort(&h.Base, errRouteNotFound)
+	}
+}
+
+// adminAccount includes the account's key, so admins can refer to it
+type adminAccount struct {
+	*core.Account
+	Key string `json:"key"`
+}
+
+type accountsPage struct {
+	Accounts      []adminAccount `json:"accounts"`
+	NextPageToken string         `json:"nextPageToken"`
+	// counted up to maxAccountEstimate; only included when requested
+	TotalEstimate *int `json:"totalEstimate,omitempty"`
+}
+
+// list returns a page of accounts. The nextPageToken is passed as the
+// pageToken to get the next page, along with the same filters; it is blank
+// for the last page. Dates are RFC 3339 and the sort is one of created,
+// -created (default), email or -email.
+//
+// 	GET /v1/admin/accounts => [200, 400, 401, 403, 500]
+// 	GET /v1/admin/accounts?status=active&createdAfter=2017-01-01T00:00:00Z&limit=50&total=true
+// 	GET /v1/admin/accounts?email=bob@example.com
+// 	GET /v1/admin/accounts?sort=email&pageToken=E-ABAIICJWoRZGV2...
+func (h *AdminAccountsHandler) list() {
+	aq, err := h.accountQuery()
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	page, err := AccountStore.List(h.Ctx, aq)
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	res := accountsPage{
+		Accounts:      []adminAccount{},
+		NextPageToken: page.Cursor,
+	}
+	for _, account := range page.Accounts {
+		res.Accounts = append(res.Accounts, adminAccount{Account: account, Key: account.Key.Encode()})
+	}
+
+	if total, _ := h.QueryParam("total"); total == "true" {
+		estimate, err := AccountStore.Estimate(h.Ctx, aq, maxAccountEstimate)
+		if err != nil {
+			abort(&h.Base, fmt.Errorf("estimating accounts: %v", err))
+			return
+		}
+		res.TotalEstimate = &estimate
+	}
+
+	h.ToJSON(&res)
+}
+
+// delete soft deletes the account as if its owner deleted it
+//
+// 	DELETE /v1/admin/accounts/{key} => [202, 401, 403, 404, 500]
+func (h *AdminAccountsHandler) delete() {
+	accountKey, err := h.accountKey(strings.TrimPrefix(h.Req.URL.Path, adminAccountsPath+"/"))
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	scheduleDeletion(&h.Base, accountKey)
+}
+
+// restore cancels the account's deletion during its grace period
+//
+// 	POST /v1/admin/accounts/{key}/restore => [204, 401, 403, 404, 409, 500]
+func (h *AdminAccountsHandler) restore() {
+	path := strings.TrimPrefix(h.Req.URL.Path, adminAccountsPath+"/")
+	accountKey, err := h.accountKey(strings.TrimSuffix(path, "/restore"))
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	err = newDeletionService().Restore(h.Ctx, accountKey)
+	if err == datastore.ErrNoSuchEntity {
+		err = errAccountNotFound
+	}
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	h.Res.WriteHeader(http.StatusNoContent)
+}
+
+// accountKey decodes the encoded account key within the path
+func (h *AdminAccountsHandler) accountKey(encoded string) (*datastore.Key, error) {
+	key, err := datastore.DecodeKey(encoded)
+	if err != nil || key.Kind() != AccountStore.TableName {
+		return nil, errAccountNotFound
+	}
+	return key, nil
+}
+
+// accountQuery reads the filters, sort order and page from the query params
+func (h *AdminAccountsHandler) accountQuery() (core.AccountQuery, error) {
+	var aq core.AccountQuery
+	aq.Email, _ = h.QueryParam("email")
+	aq.Status, _ = h.QueryParam("status")
+	aq.Order, _ = h.QueryParam("sort")
+	aq.Cursor, _ = h.QueryParam("pageToken")
+
+	var fields []core.FieldError
+	if limit, _ := h.QueryParam("limit"); len(limit) > 0 {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			fields = append(fields, core.FieldError{Field: "limit", Code: "invalid_value", Message: "limit must be a positive number"})
+		}
+		aq.Limit = n
+	}
+	aq.CreatedAfter = h.timeParam("createdAfter", &fields)
+	aq.CreatedBefore = h.timeParam("createdBefore", &fields)
+
+	if len(fields) > 0 {
+		return aq, core.InvalidFields(fields...)
+	}
+	return aq, nil
+}
+
+// timeParam returns the RFC 3339 time param, adding a field error if it isn't
+// valid; blank params are the zero time
+func (h *AdminAccountsHandler) timeParam(name string, fields *[]core.FieldError) time.Time {
+	value, _ := h.QueryParam(name)
+	if len(value) == 0 {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		*fields = append(*fields, core.FieldError{Field: name, Code: "invalid_time", Message: fmt.Sprintf("%s must be an RFC 3339 time", name)})
+	}
+	return t
+}
@@ -1,7 +1,13 @@
 package app
 
 import (
+	"encoding/base64"
+	"fmt"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/chrisolsen/ae/handler"
 	"github.com/chrisolsen/ae/que"
@@ -21,6 +27,20 @@ var (
 	TokenStore      = core.NewTokenStore()
 )
 
+// authProviders contains the providers enabled through the AUTH_PROVIDERS
+// comma separated list (facebook, google, oidc)
+var authProviders = core.AuthProviders{}
+
+// accessTokens issues stateless access tokens; nil unless ACCESS_TOKEN_KEYS is set
+var accessTokens *core.AccessTokenSigner
+
+// loginThrottle limits failed sign in attempts; thresholds are configured with
+// the LOGIN_* environment variables
+var loginThrottle = &core.LoginThrottle{}
+
+// mailer sends the emails to users
+var mailer core.Mailer = core.AppEngineMailer{Sender: os.Getenv("MAIL_SENDER")}
+
 var (
 	authMiddleware = AuthMiddleware{}
 	// set text/json response type
@@ -31,14 +51,76 @@ var (
 )
 
 func init() {
+	if cost, err := strconv.Atoi(os.Getenv("PASSWORD_COST")); err == nil {
+		core.PasswordCost = cost
+	}
+
+	for _, name := range envList("AUTH_PROVIDERS") {
+		switch name {
+		case "facebook":
+			authProviders.Register(core.FacebookProvider{
+				AppID:     os.Getenv("FACEBOOK_APP_ID"),
+				AppSecret: os.Getenv("FACEBOOK_APP_SECRET"),
+			})
+		case "google":
+			authProviders.Register(core.NewGoogleProvider(envList("GOOGLE_CLIENT_IDS")...))
+		case "oidc":
+			authProviders.Register(&core.OIDCProvider{
+				ProviderName: "oidc",
+				Issuers:      envList("OIDC_ISSUERS"),
+				JWKSURL:      os.Getenv("OIDC_JWKS_URL"),
+				ClientIDs:    envList("OIDC_CLIENT_IDS"),
+			})
+		}
+	}
+
+	accessTokens = accessTokenSigner(envList("ACCESS_TOKEN_KEYS"))
+
+	if n, err := strconv.Atoi(os.Getenv("LOGIN_FREE_ATTEMPTS")); err == nil {
+		loginThrottle.FreeAttempts = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("LOGIN_LOCKOUT_ATTEMPTS")); err == nil {
+		loginThrottle.LockoutAttempts = n
+	}
+	if minutes, err := strconv.Atoi(os.Getenv("LOGIN_LOCKOUT_MINUTES")); err == nil {
+		loginThrottle.LockoutDuration = time.Duration(minutes) * time.Minute
+	}
+
 	// no auth
 	noAuth := que.New(handler.OriginMiddleware(nil))
 	http.Handle("/v1/auth", noAuth.Handle(AuthHandler{}))
+	http.Handle("/v1/auth/refresh", noAuth.Handle(RefreshHandler{}))
+	http.Handle("/v1/auth/2fa", noAuth.Handle(TwoFactorAuthHandler{}))
 	http.Handle("/v1/signup", noAuth.Handle(SignupHandler{}))
+	http.Handle("/v1/password/", noAuth.Handle(PasswordHandler{}))
+	http.Handle("/v1/deletion/cancel", noAuth.Handle(DeletionHandler{}))
+	http.Handle("/v1/exports", noAuth.Handle(ExportDownloadHandler{}))
 
 	// auth
 	auth := que.New(handler.OriginMiddleware(nil), authMiddleware.APIAuth)
 	http.Handle("/v1/me", auth.Handle(AccountsHandler{}))
+	http.Handle("/v1/me/sessions", auth.Handle(SessionsHandler{}))
+	http.Handle("/v1/me/sessions/", auth.Handle(SessionsHandler{}))
+	http.Handle("/v1/me/credentials", auth.Handle(CredentialsHandler{}))
+	http.Handle("/v1/me/credentials/", auth.Handle(CredentialsHandler{}))
+	http.Handle("/v1/me/email/", auth.Handle(EmailHandler{}))
+	http.Handle("/v1/me/2fa/", auth.Handle(TwoFactorHandler{}))
+	http.Handle("/v1/me/export", auth.Handle(ExportHandler{}))
+	http.Handle("/v1/me/export/", auth.Handle(ExportHandler{}))
+
+	// admin
+	admin := que.New(handler.OriginMiddleware(nil), authMiddleware.APIAuth, authMiddleware.Admin)
+	http.Handle("/v1/admin/accounts", admin.Handle(AdminAccountsHandler{}))
+	http.Handle("/v1/admin/accounts/", admin.Handle(AdminAccountsHandler{}))
+
+	// tasks; restricted to admins and cron in app.yaml
+	tasks := que.New()
+	http.Handle("/tasks/purge-accounts", tasks.Handle(PurgeAccountsHandler{}))
+	http.Handle("/tasks/backfill-accounts", tasks.Handle(BackfillAccountsHandler{}))
+
+	// auth with verified email; ex.
+	// verified := que.New(handler.OriginMiddleware(nil), authMiddleware.APIAuth, authMiddleware.VerifiedEmail)
+	// http.Handle("/v1/orders", verified.Handle(OrdersHandler{}))
 
 	// static files
 	http.Handle("/static/", http.FileServer(http.Dir("static")))
@@ -48,3 +130,43 @@ func init() {
 		w.Write([]byte("qdKxHj8XnWKq91pOctds5wzZUrW7TWTH4NbmwH5oa_g.7RL12VvymIwJ6NoXGAimP_CgJQ7JrNQEjfufjLxKRiQ"))
 	})
 }
+
+// envList splits the comma separated environment variable value
+func envList(name string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// accessTokenSigner creates the signer from the `kid:base64-key` entries. The
+// first key signs new tokens while the others are only used for verification.
+func accessTokenSigner(entries []string) *core.AccessTokenSigner {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	signer := core.AccessTokenSigner{Keys: map[string][]byte{}}
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			panic(fmt.Sprintf("invalid ACCESS_TOKEN_KEYS entry %q", entry))
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			panic(fmt.Sprintf("invalid ACCESS_TOKEN_KEYS key %q: %v", parts[0], err))
+		}
+		if len(signer.KeyID) == 0 {
+			signer.KeyID = parts[0]
+		}
+		signer.Keys[parts[0]] = key
+	}
+
+	if minutes, err := strconv.Atoi(os.Getenv("ACCESS_TOKEN_TTL_MINUTES")); err == nil {
+		signer.TTL = time.Duration(minutes) * time.Minute
+	}
+	return &signer
+}
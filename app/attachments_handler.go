@@ -2,7 +2,6 @@ package app
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net/http"
 
@@ -25,7 +24,7 @@ func (h AttachmentHandler) ServeHTTP(c context.Context, w http.ResponseWriter, r
 	case http.MethodOptions:
 		h.ValidateOrigin([]string{"https://your_app.com"})
 	default:
-		h.Abort(http.StatusNotFound, nil)
+		abort(&h.Base, errRouteNotFound)
 	}
 }
 
@@ -43,13 +42,13 @@ func (h *AttachmentHandler) create() {
 
 	err = json.NewDecoder(h.Req.Body).Decode(&body)
 	if err != nil {
-		h.Abort(http.StatusBadRequest, fmt.Errorf("decode json: %v", err))
+		abort(&h.Base, errInvalidBody(err))
 		return
 	}
 
 	parentKey, ok := h.QueryKey("parent")
 	if !ok {
-		h.Abort(http.StatusBadRequest, errors.New("invalid parent querystring key"))
+		abort(&h.Base, core.NewError(core.Invalid, "invalid_parent", "invalid parent querystring key"))
 		return
 	}
 
@@ -61,7 +60,7 @@ func (h *AttachmentHandler) create() {
 		attachment, err = svc.CreateWithData(h.Ctx, body.Data, body.ContentType)
 	}
 	if err != nil {
-		h.Abort(http.StatusBadRequest, fmt.Errorf("failed finding parent: %v", err))
+		abort(&h.Base, fmt.Errorf("saving attachment: %v", err))
 		return
 	}
 
@@ -70,10 +69,10 @@ func (h *AttachmentHandler) create() {
 	case "accounts":
 		err = h.associateToAccount(parentKey, attachment)
 	default:
-		h.Abort(http.StatusBadRequest, errors.New("unhandled attachment parent"))
+		err = core.NewError(core.Invalid, "invalid_parent", "unhandled attachment parent")
 	}
 	if err != nil {
-		h.Abort(http.StatusInternalServerError, fmt.Errorf("failed to create attachment: %v", err))
+		abort(&h.Base, err)
 		return
 	}
 
@@ -83,6 +82,9 @@ func (h *AttachmentHandler) create() {
 func (h *AttachmentHandler) associateToAccount(key *datastore.Key, photo *core.Attachment) error {
 	var a core.Account
 	err := AccountStore.Get(h.Ctx, key, &a)
+	if err == datastore.ErrNoSuchEntity {
+		return core.NewError(core.NotFound, "parent_not_found", "parent account not found")
+	}
 	if err != nil {
 		return fmt.Errorf("getting account: %v", err)
 	}
@@ -91,6 +93,10 @@ func (h *AttachmentHandler) associateToAccount(key *datastore.Key, photo *core.A
 	if err != nil {
 		return fmt.Errorf("updating account: %v", err)
 	}
+	err = AttachmentStore.Record(h.Ctx, a.Key, photo)
+	if err != nil {
+		return fmt.Errorf("recording attachment: %v", err)
+	}
 
 	return nil
 }
@@ -2,12 +2,14 @@ package app
 
 import (
 	"encoding/json"
-	"errors"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/chrisolsen/ae/handler"
 	"github.com/chrisolsen/aetemplate/core"
 	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
 )
 
 type AuthHandler struct {
@@ -18,52 +20,150 @@ func (h AuthHandler) ServeHTTP(c context.Context, w http.ResponseWriter, r *http
 	h.Bind(c, w, r)
 	svc := core.AuthService{
 		URLGetter: core.AppEngineURLGetter{Ctx: c},
+		Providers: authProviders,
+		Device:    requestDevice(r),
+		TwoFactor: newTwoFactorService(),
+		Throttle:  loginThrottle,
 	}
 	switch r.Method {
 	case http.MethodPost:
 		h.authenticateUser(svc.Authenticate)
+	case http.MethodDelete:
+		h.revokeToken()
 	case http.MethodOptions:
 		h.ValidateOrigin(nil)
 	default:
-		h.Abort(http.StatusNotFound, nil)
+		abort(&h.Base, errRouteNotFound)
 	}
 }
 
 // Authenticate authenticates the submitted credentials and returns an auth token
 // for the found acccount in the response. The credentials can either include
-// authh provider details or email/password
+// authh provider details or username/password
 //
 // 	200 - authenticated
+// 	202 - second factor required; the challenge is exchanged at /v1/auth/2fa
 // 	401 - not authenticated
-//  400 - bad request
+// 	400 - bad request
+// 	429 - too many failed attempts; retry after the Retry-After seconds
+// 	500 - unexpected error
 //
 // 	POST /v1/auth
 //	{
-// 		"accountKey": "12352345",  			// passed in on initial signup only
 //  	"providerId": 21234234,
 //  	"providerName": "facebook",
 //  	"providerToken": "8a7wi2jrhfas...",
 //
-// 		"email": "john@example.com",
+// 		"username": "john@example.com",
 // 		"password": "foobar"
 //  }
 func (h *AuthHandler) authenticateUser(authenticate core.AuthFunc) {
 	var creds core.Credentials
 	err := json.NewDecoder(h.Req.Body).Decode(&creds)
 	if err != nil {
-		h.Abort(http.StatusBadRequest, err)
+		abort(&h.Base, errInvalidBody(err))
 		return
 	}
 
-	if !creds.Valid() {
-		h.Abort(http.StatusBadRequest, errors.New("missing required credentials"))
+	err = creds.Validate()
+	if err != nil {
+		abort(&h.Base, err)
 		return
 	}
 
 	token, err := authenticate(h.Ctx, &creds)
+	if challenge, ok := err.(*core.SecondFactorRequired); ok {
+		h.ToJSONWithStatus(&challengeResponse{
+			SecondFactorRequired: true,
+			Challenge:            challenge.Challenge,
+			Expiry:               challenge.Expiry,
+		}, http.StatusAccepted)
+		return
+	}
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	res, err := newTokenResponse(token.Key.Parent(), token.Value(), token.Expiry)
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	h.ToJSON(res)
+}
+
+// tokenResponse contains the token used to authenticate requests. When
+// stateless access tokens are enabled the token is only used as a refresh
+// token and requests are authenticated with the access token.
+type tokenResponse struct {
+	Token             string     `json:"token"`
+	Expiry            time.Time  `json:"expiry"`
+	AccessToken       string     `json:"accessToken,omitempty"`
+	AccessTokenExpiry *time.Time `json:"accessTokenExpiry,omitempty"`
+}
+
+// challengeResponse is returned in place of the token for accounts with two
+// factor authentication enabled
+type challengeResponse struct {
+	SecondFactorRequired bool      `json:"secondFactorRequired"`
+	Challenge            string    `json:"challenge"`
+	Expiry               time.Time `json:"expiry"`
+}
+
+func newTokenResponse(accountKey *datastore.Key, token string, expiry time.Time) (*tokenResponse, error) {
+	res := tokenResponse{Token: token, Expiry: expiry}
+	if accessTokens == nil {
+		return &res, nil
+	}
+
+	accessToken, accessExpiry, err := accessTokens.Sign(accountKey)
+	if err != nil {
+		return nil, fmt.Errorf("signing access token: %v", err)
+	}
+	res.AccessToken = accessToken
+	res.AccessTokenExpiry = &accessExpiry
+	return &res, nil
+}
+
+// revokeToken signs out the token within the Authorization header. All of the
+// account's tokens are revoked when the `all` param is set.
+//
+// 	204 - revoked
+// 	401 - not authenticated
+//
+// 	DELETE /v1/auth
+// 	DELETE /v1/auth?all=true
+func (h *AuthHandler) revokeToken() {
+	rawToken, err := headerToken(h.Req)
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	details, err := authMiddleware.getTokenDetails(h.Ctx, rawToken)
 	if err != nil {
-		h.Abort(http.StatusUnauthorized, err)
+		abort(&h.Base, err)
+		return
+	}
+
+	var key *datastore.Key
+	if all, _ := h.QueryParam("all"); all == "true" {
+		key, err = datastore.DecodeKey(details.AccountKey)
+		if err == nil {
+			err = TokenStore.RevokeAll(h.Ctx, key)
+		}
+	} else {
+		key, err = datastore.DecodeKey(details.Token)
+		if err == nil {
+			err = TokenStore.Revoke(h.Ctx, key)
+		}
+	}
+	if err != nil {
+		abort(&h.Base, fmt.Errorf("revoking token: %v", err))
+		return
 	}
 
-	h.ToJSON(token)
+	h.Res.WriteHeader(http.StatusNoContent)
 }
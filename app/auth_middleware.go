@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/chrisolsen/aetemplate/core"
@@ -20,22 +21,45 @@ const (
 
 // Errors
 var (
-	errMissingAuthToken   = errors.New("Auth token does not exist")
-	errMissingAuthHeader  = errors.New("No authorization header supplied")
-	errMultipleAuthTokens = errors.New("Duplicate auth token exist")
+	errMissingAuthToken    = core.NewError(core.Unauthorized, "invalid_token", "Auth token does not exist")
+	errMissingAuthHeader   = core.NewError(core.Unauthorized, "missing_token", "No authorization header supplied")
+	errMultipleAuthTokens  = errors.New("Duplicate auth token exist")
+	errExpiredToken        = core.NewError(core.Unauthorized, "expired_token", "Auth token has expired")
+	errEmailNotVerified    = core.NewError(core.Forbidden, "email_not_verified", "Email address has not been verified")
+	errAdminRequired       = core.NewError(core.Forbidden, "admin_required", "Admin access is required")
+	errAccessTokenRequired = core.NewError(core.Unauthorized, "access_token_required", "A bearer access token is required")
 )
 
+// errInvalidAuthToken is returned for malformed auth tokens
+func errInvalidAuthToken(err error) error {
+	return &core.Error{
+		Kind:    core.Unauthorized,
+		Code:    "invalid_token",
+		Message: "invalid auth token",
+		Err:     err,
+	}
+}
+
 // Token keys
 const (
 	newTokenHeader       string = "new-auth-token"
 	newTokenExpiryHeader string = "new-auth-token-expiry"
 )
 
+// how stale a token's last used time can be before it is saved again
+const lastUsedInterval = time.Minute * 15
+
 // TokenDetails is the data type that is stored in memcache using the token as a key.
 type tokenDetails struct {
 	Expiry     time.Time
 	AccountKey string
-	Token      string
+	// encoded token key; the token value is never cached
+	Token    string
+	LastUsed time.Time
+
+	// encoded key of the token's successor, set once the token has been rotated
+	Successor       string
+	SuccessorExpiry time.Time
 }
 
 func (t *tokenDetails) isExpired() bool {
@@ -47,6 +71,16 @@ func (t *tokenDetails) willExpireIn(duration time.Duration) bool {
 	return t.Expiry.Before(future)
 }
 
+// needsRotation indicates if the token should be replaced, either because it
+// expires within a week or is a legacy token whose value is its datastore key
+func (t *tokenDetails) needsRotation() bool {
+	if t.willExpireIn(time.Hour * 24 * 7) {
+		return true
+	}
+	key, err := datastore.DecodeKey(t.Token)
+	return err == nil && len(key.StringID()) == 0
+}
+
 // AuthMiddleware .
 type AuthMiddleware struct{}
 
@@ -86,8 +120,8 @@ func (a *AuthMiddleware) FormAuth(c context.Context, w http.ResponseWriter, r *h
 	}
 
 	// if the token's expiry less than a week away, get new token
-	if tokenDetails.willExpireIn(time.Hour * 24 * 7) {
-		newToken, err := a.getNewToken(c, accountKey)
+	if tokenDetails.needsRotation() {
+		newToken, _, err := a.rotateToken(c, tokenDetails, cookie.Value, r)
 		if err != nil {
 			http.Redirect(w, r, returnURL, http.StatusTemporaryRedirect)
 			cancel()
@@ -95,15 +129,19 @@ func (a *AuthMiddleware) FormAuth(c context.Context, w http.ResponseWriter, r *h
 		}
 
 		// send back the new token values
-		http.SetCookie(w, &http.Cookie{
-			Name:     cookieName,
-			Expires:  time.Now().Add(time.Hour * 24 * 14), // 2 weeks from now
-			HttpOnly: true,
-			Secure:   !appengine.IsDevAppServer(),
-			Value:    newToken.Value(),
-		})
+		if len(newToken) > 0 {
+			http.SetCookie(w, &http.Cookie{
+				Name:     cookieName,
+				Expires:  time.Now().Add(time.Hour * 24 * 14), // 2 weeks from now
+				HttpOnly: true,
+				Secure:   !appengine.IsDevAppServer(),
+				Value:    newToken,
+			})
+		}
 	}
 
+	a.touchToken(c, tokenDetails)
+
 	// add accountKey to context
 	c = session.SetAccountKey(c, accountKey)
 
@@ -120,83 +158,181 @@ func (a *AuthMiddleware) APIAuth(c context.Context, w http.ResponseWriter, r *ht
 	var err error
 	c, cancel := context.WithCancel(c)
 
-	authHeader := r.Header.Get("Authorization")
-	if len(authHeader) <= len("token=") {
-		log.Errorf(c, "missing token header: %v", err)
-		w.WriteHeader(http.StatusUnauthorized)
-		cancel()
-		return c
+	// signed access tokens are verified without a storage lookup. Once they are
+	// enabled the auth token is only a refresh token, accepted at
+	// /v1/auth/refresh and DELETE /v1/auth only.
+	if accessTokens != nil {
+		accessToken, ok := bearerToken(r)
+		if !ok {
+			writeProblem(c, w, r, errAccessTokenRequired)
+			cancel()
+			return c
+		}
+		accountKey, err := accessTokens.Verify(accessToken)
+		if err != nil {
+			writeProblem(c, w, r, errInvalidAuthToken(err))
+			cancel()
+			return c
+		}
+		// deleted accounts' tokens are revoked, but access tokens remain valid
+		// until they expire
+		if a.isDeleted(c, accountKey) {
+			writeProblem(c, w, r, core.ErrAccountPendingDeletion)
+			cancel()
+			return c
+		}
+		return session.SetAccountKey(c, accountKey)
 	}
 
 	// prevent token caching with blank string value
-	rawToken := authHeader[len("token="):]
-	if len(rawToken) == 0 {
-		log.Errorf(c, "missing token value: %v", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	rawToken, err := headerToken(r)
+	if err != nil {
+		writeProblem(c, w, r, err)
 		cancel()
 		return c
 	}
 
 	tokenDetails, err := a.getTokenDetails(c, rawToken)
 	if err != nil {
-		log.Errorf(c, "failed to get token details: %v", err)
-		w.WriteHeader(http.StatusUnauthorized)
+		writeProblem(c, w, r, err)
 		cancel()
 		return c
 	}
 
 	// if token has expired return 401
 	if tokenDetails.isExpired() {
-		log.Errorf(c, "expired Token")
-		w.WriteHeader(http.StatusUnauthorized)
+		writeProblem(c, w, r, errExpiredToken)
 		cancel()
 		return c
 	}
 
 	accountKey, err := datastore.DecodeKey(tokenDetails.AccountKey)
 	if err != nil {
-		log.Errorf(c, "failed to decode account key: %v", err)
-		w.WriteHeader(http.StatusUnauthorized)
+		writeProblem(c, w, r, errInvalidAuthToken(err))
 		cancel()
 		return c
 	}
 
 	// if the token's expiry less than a week away, get new token
-	if tokenDetails.willExpireIn(time.Hour * 24 * 7) {
-		newToken, err := a.getNewToken(c, accountKey)
+	if tokenDetails.needsRotation() {
+		newToken, newTokenExpiry, err := a.rotateToken(c, tokenDetails, rawToken, r)
 		if err != nil {
-			log.Errorf(c, "failed to create new token: %v", err)
-			w.WriteHeader(http.StatusUnauthorized)
+			writeProblem(c, w, r, err)
 			cancel()
 			return c
 		}
 
 		// send back the new token values
-		w.Header().Add(newTokenHeader, newToken.Value())
-		w.Header().Add(newTokenExpiryHeader, newToken.Expiry.Format(time.RFC3339))
+		if len(newToken) > 0 {
+			w.Header().Add(newTokenHeader, newToken)
+			w.Header().Add(newTokenExpiryHeader, newTokenExpiry.Format(time.RFC3339))
+		}
 	}
 
+	a.touchToken(c, tokenDetails)
+
 	// add accountKey to context
 	c = session.SetAccountKey(c, accountKey)
 
 	return c
 }
 
+// VerifiedEmail blocks requests from accounts that haven't verified their
+// email. Must follow the APIAuth middleware.
+func (a *AuthMiddleware) VerifiedEmail(c context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+	if r.Method == http.MethodOptions {
+		return c
+	}
+
+	c, cancel := context.WithCancel(c)
+
+	// stored rather than session account, so emails verified since the
+	// account was cached are allowed
+	account, err := storedAccount(c)
+	if err != nil {
+		writeProblem(c, w, r, errSessionAccount(err))
+		cancel()
+		return c
+	}
+
+	if account.EmailVerified.IsZero() {
+		writeProblem(c, w, r, errEmailNotVerified)
+		cancel()
+		return c
+	}
+
+	return c
+}
+
+// Admin blocks requests from accounts that aren't admins. Must follow the
+// APIAuth middleware.
+func (a *AuthMiddleware) Admin(c context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+	if r.Method == http.MethodOptions {
+		return c
+	}
+
+	c, cancel := context.WithCancel(c)
+
+	var account core.Account
+	err := session.Account(c, &account)
+	if err != nil {
+		writeProblem(c, w, r, errSessionAccount(err))
+		cancel()
+		return c
+	}
+
+	if !account.Admin {
+		writeProblem(c, w, r, errAdminRequired)
+		cancel()
+		return c
+	}
+
+	return c
+}
+
+// isDeleted indicates if the account has been flagged as deleted. Cache
+// failures are only logged, so they don't block the request.
+func (a *AuthMiddleware) isDeleted(c context.Context, accountKey *datastore.Key) bool {
+	_, err := memcache.Get(c, core.DeletedAccountCacheKey(accountKey))
+	if err != nil && err != memcache.ErrCacheMiss {
+		log.Warningf(c, "checking deleted account: %v", err)
+	}
+	return err == nil
+}
+
+// headerToken returns the raw token value within the `Authorization: token=...`
+// request header
+func headerToken(r *http.Request) (string, error) {
+	authHeader := r.Header.Get("Authorization")
+	if len(authHeader) <= len("token=") {
+		return "", errMissingAuthHeader
+	}
+	return authHeader[len("token="):], nil
+}
+
+// bearerToken returns the signed access token within the
+// `Authorization: Bearer ...` request header
+func bearerToken(r *http.Request) (string, bool) {
+	authHeader := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") || len(authHeader) == len("Bearer ") {
+		return "", false
+	}
+	return authHeader[len("Bearer "):], true
+}
+
 // Gets the token for the rawToken value
 func (a *AuthMiddleware) getTokenDetails(c context.Context, rawToken string) (*tokenDetails, error) {
-	var err error
+	tokenKey, _, err := core.ParseToken(c, rawToken)
+	if err != nil {
+		return nil, errInvalidAuthToken(err)
+	}
 
-	tokenDetails, err := a.getCacheToken(c, rawToken)
+	tokenDetails, err := a.getCacheToken(c, tokenKey)
 	if err != nil && err != memcache.ErrCacheMiss {
 		return nil, err
 	}
 
 	if err == memcache.ErrCacheMiss {
-		tokenKey, err := datastore.DecodeKey(rawToken)
-		if err != nil {
-			return nil, fmt.Errorf("decoding token key: %v", err)
-		}
-
 		var token core.Token
 		err = TokenStore.Get(c, tokenKey, &token)
 		if err != nil {
@@ -216,25 +352,29 @@ func (a *AuthMiddleware) getTokenDetails(c context.Context, rawToken string) (*t
 	return tokenDetails, nil
 }
 
-// getCacheToken attemps to fetch the token details for the raw token string passed in
-func (a *AuthMiddleware) getCacheToken(c context.Context, rawToken string) (*tokenDetails, error) {
+// getCacheToken attemps to fetch the token details for the token key passed in
+func (a *AuthMiddleware) getCacheToken(c context.Context, tokenKey *datastore.Key) (*tokenDetails, error) {
 	var tokenDetails tokenDetails
-	_, err := memcache.JSON.Get(c, rawToken, &tokenDetails)
+	_, err := memcache.JSON.Get(c, core.TokenCacheKey(tokenKey), &tokenDetails)
 
 	return &tokenDetails, err
 }
 
-// setCacheToken memcaches the passed in raw token value
+// setCacheToken memcaches the token's details
 func (a *AuthMiddleware) setCacheToken(c context.Context, accountKey *datastore.Key, token *core.Token) (*tokenDetails, error) {
 	tokenDetails := tokenDetails{
 		AccountKey: accountKey.Encode(),
 		Expiry:     token.Expiry,
-		Token:      token.Value(),
+		Token:      token.Key.Encode(),
+		LastUsed:   token.LastUsedAt,
+	}
+	if token.Successor != nil {
+		tokenDetails.Successor = token.Successor.Encode()
 	}
 
 	// save to memcache
 	err := memcache.JSON.Set(c, &memcache.Item{
-		Key:        token.Value(),
+		Key:        core.TokenCacheKey(token.Key),
 		Object:     tokenDetails,
 		Expiration: -1 * time.Since(token.Expiry),
 	})
@@ -245,11 +385,68 @@ func (a *AuthMiddleware) setCacheToken(c context.Context, accountKey *datastore.
 	return &tokenDetails, nil
 }
 
-// Creates a new token and links it to the account for the old token
-func (a *AuthMiddleware) getNewToken(c context.Context, accountKey *datastore.Key) (*core.Token, error) {
-	if accountKey == nil {
-		return nil, errors.New("account key is required to create a token")
+// touchToken periodically saves the token's last used time. Failures are only
+// logged since they shouldn't prevent the request.
+func (a *AuthMiddleware) touchToken(c context.Context, details *tokenDetails) {
+	now := time.Now()
+	if now.Sub(details.LastUsed) < lastUsedInterval {
+		return
+	}
+
+	tokenKey, err := datastore.DecodeKey(details.Token)
+	if err != nil {
+		log.Warningf(c, "decoding token key: %v", err)
+		return
+	}
+
+	err = TokenStore.Touch(c, tokenKey, now)
+	if err != nil {
+		log.Warningf(c, "saving token last used time: %v", err)
+		return
+	}
+
+	// cleared rather than updated, so a token revoked since it was cached isn't
+	// cached again; the next request reloads it from the datastore
+	details.LastUsed = now
+	err = memcache.Delete(c, core.TokenCacheKey(tokenKey))
+	if err != nil && err != memcache.ErrCacheMiss {
+		log.Warningf(c, "clearing cached token: %v", err)
+	}
+}
+
+// rotateToken returns the value and expiry of the token's successor, creating
+// it the first time the token is rotated. Parallel requests receive the same
+// new token during the rotation grace period; afterwards the value is blank.
+func (a *AuthMiddleware) rotateToken(c context.Context, details *tokenDetails, rawToken string, r *http.Request) (string, time.Time, error) {
+	tokenKey, _, err := core.ParseToken(c, rawToken)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	if len(details.Successor) > 0 && !details.SuccessorExpiry.IsZero() {
+		successorKey, err := datastore.DecodeKey(details.Successor)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		return TokenStore.SuccessorValue(c, tokenKey, successorKey), details.SuccessorExpiry, nil
+	}
+
+	rotated, successor, err := TokenStore.Rotate(c, tokenKey, requestDevice(r))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	details.Expiry = rotated.Expiry
+	details.Successor = successor.Key.Encode()
+	details.SuccessorExpiry = successor.Expiry
+	err = memcache.JSON.Set(c, &memcache.Item{
+		Key:        core.TokenCacheKey(tokenKey),
+		Object:     details,
+		Expiration: -1 * time.Since(rotated.Expiry),
+	})
+	if err != nil {
+		log.Warningf(c, "caching rotated token: %v", err)
 	}
 
-	return TokenStore.Create(c, accountKey)
+	return successor.Value(), successor.Expiry, nil
 }
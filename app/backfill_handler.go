@@ -0,0 +1,54 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/chrisolsen/ae/handler"
+	"github.com/chrisolsen/aetemplate/core"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/log"
+)
+
+// backfillBatchSize is how many accounts each backfill task checks
+const backfillBatchSize = 1000
+
+// backfillAccounts backfills a batch of accounts in a task queue task, then
+// queues the next batch until all accounts have been checked
+var backfillAccounts = delay.Func("backfillAccounts", func(c context.Context, cursor string) error {
+	aStore := core.NewAccountStore()
+	next, err := aStore.Backfill(c, cursor, backfillBatchSize)
+	if core.KindOf(err) == core.Invalid {
+		log.Errorf(c, "skipping account backfill: %v", err)
+		return nil
+	}
+	if err != nil {
+		log.Errorf(c, "backfilling accounts: %v", err)
+		return err
+	}
+	if len(next) == 0 {
+		log.Infof(c, "account backfill finished")
+		return nil
+	}
+	return backfillAccounts.Call(c, next)
+})
+
+// BackfillAccountsHandler starts the backfill of accounts saved before their
+// status, creation time and reservations were stored; run once by an admin
+// after deploying
+type BackfillAccountsHandler struct {
+	handler.Base
+}
+
+// GET /tasks/backfill-accounts => [202, 500]
+func (h BackfillAccountsHandler) ServeHTTP(c context.Context, w http.ResponseWriter, r *http.Request) {
+	h.Bind(c, w, r)
+
+	err := backfillAccounts.Call(c, "")
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	h.Res.WriteHeader(http.StatusAccepted)
+}
@@ -1,7 +1,10 @@
 package app
 
 import (
+	"net/http"
+
 	"github.com/chrisolsen/ae/store"
+	"github.com/chrisolsen/aetemplate/core"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/datastore"
 )
@@ -25,3 +28,27 @@ type modelCopier interface {
 type modelDeleter interface {
 	Delete(c context.Context, key *datastore.Key) error
 }
+
+// requestDevice returns the details of the client making the request
+func requestDevice(r *http.Request) core.Device {
+	return core.Device{
+		UserAgent: r.UserAgent(),
+		IP:        r.RemoteAddr,
+	}
+}
+
+// storedAccount returns the signed in account from the datastore. The session
+// caches the account, and the cached copy isn't updated when it is saved.
+func storedAccount(c context.Context) (*core.Account, error) {
+	accountKey, err := session.AccountKey(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var account core.Account
+	err = AccountStore.Get(c, accountKey, &account)
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
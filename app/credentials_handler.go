@@ -0,0 +1,169 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/chrisolsen/ae/handler"
+	"github.com/chrisolsen/aetemplate/core"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+const credentialsPath = "/v1/me/credentials"
+
+// CredentialsHandler links and unlinks the account's login methods
+type CredentialsHandler struct {
+	handler.Base
+}
+
+// credentialInfo is the public view of a login method; secrets are never exposed
+type credentialInfo struct {
+	ID           string `json:"id"`
+	Type         string `json:"type"`
+	ProviderName string `json:"providerName,omitempty"`
+	ProviderID   string `json:"providerId,omitempty"`
+	Username     string `json:"username,omitempty"`
+}
+
+func newCredentialInfo(key *datastore.Key, creds *core.Credentials) credentialInfo {
+	info := credentialInfo{
+		ID:           strconv.FormatInt(key.IntID(), 10),
+		ProviderName: creds.ProviderName,
+		ProviderID:   creds.ProviderID,
+		Username:     creds.Username,
+	}
+	if len(creds.ProviderName) > 0 {
+		info.Type = "provider"
+	} else {
+		info.Type = "password"
+	}
+	return info
+}
+
+func (h CredentialsHandler) ServeHTTP(c context.Context, w http.ResponseWriter, r *http.Request) {
+	h.Bind(c, w, r)
+	svc := core.AuthService{
+		URLGetter: core.AppEngineURLGetter{Ctx: c},
+		Providers: authProviders,
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.list()
+	case http.MethodPost:
+		h.link(svc.Verify)
+	case http.MethodDelete:
+		h.unlink()
+	case http.MethodOptions:
+		h.ValidateOrigin(nil)
+	default:
+		abort(&h.Base, errRouteNotFound)
+	}
+}
+
+// GET /v1/me/credentials => [200, 500]
+func (h *CredentialsHandler) list() {
+	accountKey, err := session.AccountKey(h.Ctx)
+	if err != nil {
+		abort(&h.Base, errSessionAccount(err))
+		return
+	}
+
+	var creds []*core.Credentials
+	keys, err := CredentialStore.GetByParent(h.Ctx, accountKey, &creds)
+	if err != nil {
+		abort(&h.Base, fmt.Errorf("getting credentials: %v", err))
+		return
+	}
+
+	infos := []credentialInfo{}
+	for i, key := range keys {
+		infos = append(infos, newCredentialInfo(key, creds[i]))
+	}
+
+	h.ToJSON(infos)
+}
+
+// link adds a provider or username / password login to the account. Provider
+// tokens are verified before they are linked.
+//
+// 	POST /v1/me/credentials => [201, 400, 401, 409, 500]
+// 	{
+// 		"providerId": "234324523",
+// 		"providerName": "google",
+// 		"providerToken": "9q8763w4iwqr",
+//
+// 		"username": "bob@example.com",
+// 		"password": "foobario"
+// 	}
+func (h *CredentialsHandler) link(verify core.VerifyFunc) {
+	var creds core.Credentials
+	err := json.NewDecoder(h.Req.Body).Decode(&creds)
+	if err != nil {
+		abort(&h.Base, errInvalidBody(err))
+		return
+	}
+	err = creds.Validate()
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	accountKey, err := session.AccountKey(h.Ctx)
+	if err != nil {
+		abort(&h.Base, errSessionAccount(err))
+		return
+	}
+
+	if len(creds.ProviderName) > 0 {
+		_, err = verify(h.Ctx, &creds)
+		if err != nil {
+			abort(&h.Base, err)
+			return
+		}
+	}
+
+	// only one of the two credential types is linked at a time
+	if len(creds.ProviderName) > 0 {
+		creds.Username, creds.Password = "", ""
+	} else {
+		creds.ProviderID, creds.ProviderName = "", ""
+	}
+	creds.AccountKey = nil
+
+	key, err := CredentialStore.Link(h.Ctx, accountKey, &creds)
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	h.ToJSONWithStatus(newCredentialInfo(key, &creds), http.StatusCreated)
+}
+
+// DELETE /v1/me/credentials/{id} => [204, 400, 404, 409, 500]
+func (h *CredentialsHandler) unlink() {
+	id, err := strconv.ParseInt(strings.TrimPrefix(h.Req.URL.Path, credentialsPath+"/"), 10, 64)
+	if err != nil {
+		abort(&h.Base, errRequired("id"))
+		return
+	}
+
+	accountKey, err := session.AccountKey(h.Ctx)
+	if err != nil {
+		abort(&h.Base, errSessionAccount(err))
+		return
+	}
+
+	key := datastore.NewKey(h.Ctx, CredentialStore.TableName, "", id, accountKey)
+	err = CredentialStore.Unlink(h.Ctx, accountKey, key)
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	h.Res.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,121 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/chrisolsen/ae/handler"
+	"github.com/chrisolsen/aetemplate/core"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+func newDeletionService() *core.DeletionService {
+	svc := core.DeletionService{
+		Mailer:     mailer,
+		RestoreURL: os.Getenv("ACCOUNT_RESTORE_URL"),
+		Storage:    AttachmentStore,
+	}
+	if days, err := strconv.Atoi(os.Getenv("ACCOUNT_DELETION_GRACE_DAYS")); err == nil {
+		svc.GracePeriod = time.Duration(days) * time.Hour * 24
+	}
+	return &svc
+}
+
+// deletionResponse tells when the deleted account will be purged
+type deletionResponse struct {
+	DeleteAfter time.Time `json:"deleteAfter"`
+}
+
+// scheduleDeletion soft deletes the account and emails the code that restores
+// it; shared by the account and admin handlers
+func scheduleDeletion(h *handler.Base, accountKey *datastore.Key) {
+	svc := newDeletionService()
+	deleteAfter, err := svc.Schedule(h.Ctx, accountKey)
+	if err != nil {
+		abort(h, err)
+		return
+	}
+
+	// a failed email shouldn't fail the deletion; admins can still restore it
+	err = svc.SendRestoreCode(h.Ctx, accountKey)
+	if err != nil {
+		log.Errorf(h.Ctx, "sending restore code: %v", err)
+	}
+
+	h.ToJSONWithStatus(&deletionResponse{DeleteAfter: deleteAfter}, http.StatusAccepted)
+}
+
+// DeletionHandler cancels account deletions with the emailed restore code.
+// Deleted accounts are signed out, so no auth is required.
+type DeletionHandler struct {
+	handler.Base
+}
+
+func (h DeletionHandler) ServeHTTP(c context.Context, w http.ResponseWriter, r *http.Request) {
+	h.Bind(c, w, r)
+	switch r.Method {
+	case http.MethodPost:
+		h.cancel()
+	case http.MethodOptions:
+		h.ValidateOrigin(nil)
+	default:
+		abort(&h.Base, errRouteNotFound)
+	}
+}
+
+// cancel restores the account the code was emailed to
+//
+// 	POST /v1/deletion/cancel => [204, 400, 409, 500]
+// 	{
+// 		"code": "ahFkZXZ..."
+// 	}
+func (h *DeletionHandler) cancel() {
+	var body struct {
+		Code string `json:"code"`
+	}
+	err := json.NewDecoder(h.Req.Body).Decode(&body)
+	if err != nil || len(body.Code) == 0 {
+		abort(&h.Base, errRequired("code"))
+		return
+	}
+
+	err = newDeletionService().Cancel(h.Ctx, body.Code)
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	h.Res.WriteHeader(http.StatusNoContent)
+}
+
+// PurgeAccountsHandler hard deletes the accounts whose deletion grace period
+// has ended; run by cron
+type PurgeAccountsHandler struct {
+	handler.Base
+}
+
+// GET /tasks/purge-accounts => [200, 403, 500]
+func (h PurgeAccountsHandler) ServeHTTP(c context.Context, w http.ResponseWriter, r *http.Request) {
+	h.Bind(c, w, r)
+
+	// cron requests have the header set by App Engine, which strips it from
+	// external requests
+	if r.Header.Get("X-Appengine-Cron") != "true" {
+		abort(&h.Base, core.NewError(core.Forbidden, "cron_only", "only cron can purge accounts"))
+		return
+	}
+
+	count, err := newDeletionService().Purge(c)
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	log.Infof(c, "purged %d accounts", count)
+	h.ToJSON(map[string]int{"purged": count})
+}
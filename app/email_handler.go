@@ -0,0 +1,94 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/chrisolsen/ae/handler"
+	"github.com/chrisolsen/aetemplate/core"
+	"golang.org/x/net/context"
+)
+
+// EmailHandler confirms the signed in account's email
+type EmailHandler struct {
+	handler.Base
+}
+
+func newEmailVerifier() *core.EmailVerifier {
+	return &core.EmailVerifier{
+		Mailer:    mailer,
+		VerifyURL: os.Getenv("EMAIL_VERIFY_URL"),
+	}
+}
+
+func (h EmailHandler) ServeHTTP(c context.Context, w http.ResponseWriter, r *http.Request) {
+	h.Bind(c, w, r)
+	verifier := newEmailVerifier()
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/me/email/verify":
+		h.verify(verifier)
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/me/email/resend":
+		h.resend(verifier)
+	case r.Method == http.MethodOptions:
+		h.ValidateOrigin(nil)
+	default:
+		abort(&h.Base, errRouteNotFound)
+	}
+}
+
+// verify confirms the email with the emailed verification code
+//
+// 	POST /v1/me/email/verify => [204, 400, 500]
+// 	{
+// 		"code": "ahFkZXZ..."
+// 	}
+func (h *EmailHandler) verify(verifier *core.EmailVerifier) {
+	var body struct {
+		Code string `json:"code"`
+	}
+	err := json.NewDecoder(h.Req.Body).Decode(&body)
+	if err != nil || len(body.Code) == 0 {
+		abort(&h.Base, errRequired("code"))
+		return
+	}
+
+	accountKey, err := session.AccountKey(h.Ctx)
+	if err != nil {
+		abort(&h.Base, errSessionAccount(err))
+		return
+	}
+
+	err = verifier.Verify(h.Ctx, accountKey, body.Code)
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	h.Res.WriteHeader(http.StatusNoContent)
+}
+
+// resend emails a new verification code, replacing any previous codes
+//
+// 	POST /v1/me/email/resend => [202, 409, 500]
+func (h *EmailHandler) resend(verifier *core.EmailVerifier) {
+	accountKey, err := session.AccountKey(h.Ctx)
+	if err != nil {
+		abort(&h.Base, errSessionAccount(err))
+		return
+	}
+
+	err = verifier.Start(h.Ctx, accountKey)
+	if err == core.ErrEmailAlreadyVerified {
+		abort(&h.Base, err)
+		return
+	}
+	if err != nil {
+		abort(&h.Base, fmt.Errorf("sending verification email: %v", err))
+		return
+	}
+
+	h.Res.WriteHeader(http.StatusAccepted)
+}
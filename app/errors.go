@@ -0,0 +1,132 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/chrisolsen/ae/handler"
+	"github.com/chrisolsen/aetemplate/core"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+// errRouteNotFound is returned for unhandled paths and methods
+var errRouteNotFound = core.NewError(core.NotFound, "not_found", "not found")
+
+// problemTypeBase prefixes error codes to form the problem type URIs
+const problemTypeBase = "/problems/"
+
+// problem is the RFC 7807 body of error responses. The code, which the type
+// ends with, is stable, so clients can check it rather than the detail.
+type problem struct {
+	Type      string            `json:"type"`
+	Title     string            `json:"title"`
+	Status    int               `json:"status"`
+	Detail    string            `json:"detail,omitempty"`
+	Instance  string            `json:"instance,omitempty"`
+	Code      string            `json:"code"`
+	RequestID string            `json:"requestId"`
+	Errors    []core.FieldError `json:"errors,omitempty"`
+}
+
+// abort responds to the handler's request with the error's problem document
+func abort(h *handler.Base, err error) {
+	writeProblem(h.Ctx, h.Res, h.Req, err)
+}
+
+// writeProblem logs the error and responds with the problem document matching
+// its kind. The details of unexpected errors are only returned by the dev
+// server since they may contain internal details.
+func writeProblem(c context.Context, w http.ResponseWriter, r *http.Request, err error) {
+	status := errorStatus(err)
+	code := core.CodeOf(err)
+	p := problem{
+		Type:      problemTypeBase + code,
+		Title:     http.StatusText(status),
+		Status:    status,
+		Instance:  r.URL.Path,
+		Code:      code,
+		RequestID: appengine.RequestID(c),
+		Errors:    core.FieldsOf(err),
+	}
+
+	if e, ok := err.(*core.Error); ok && status < http.StatusInternalServerError {
+		p.Detail = e.Message
+	}
+	if status >= http.StatusInternalServerError && appengine.IsDevAppServer() {
+		p.Detail = err.Error()
+	}
+	if throttled, ok := err.(*core.ThrottledError); ok {
+		p.Code = "too_many_attempts"
+		p.Type = problemTypeBase + p.Code
+		p.Detail = "too many failed attempts"
+		seconds := int64(math.Ceil(throttled.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	}
+
+	if status >= http.StatusInternalServerError {
+		log.Errorf(c, "%d: %v", status, err)
+	} else {
+		log.Infof(c, "%d: %v", status, err)
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&p)
+}
+
+// errorStatus maps the error's kind to its response status
+func errorStatus(err error) int {
+	if _, ok := err.(*core.ThrottledError); ok {
+		return http.StatusTooManyRequests
+	}
+	if err == core.ErrStaleAccount {
+		return http.StatusPreconditionFailed
+	}
+
+	switch core.KindOf(err) {
+	case core.NotFound:
+		return http.StatusNotFound
+	case core.Conflict:
+		return http.StatusConflict
+	case core.Invalid:
+		return http.StatusBadRequest
+	case core.Unauthorized:
+		return http.StatusUnauthorized
+	case core.Forbidden:
+		return http.StatusForbidden
+	case core.Upstream:
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// errInvalidBody is returned when the request body can't be decoded
+func errInvalidBody(err error) error {
+	return &core.Error{
+		Kind:    core.Invalid,
+		Code:    "invalid_body",
+		Message: "the request body is not valid JSON",
+		Err:     err,
+	}
+}
+
+// errRequired is returned when a required request value is missing
+func errRequired(name string) error {
+	return core.NewError(core.Invalid, "missing_"+name, fmt.Sprintf("%s is required", name))
+}
+
+// errSessionAccount is returned when the signed in account can't be loaded
+func errSessionAccount(err error) error {
+	return &core.Error{
+		Kind:    core.Unauthorized,
+		Code:    "account_not_found",
+		Message: "unable to get account from token",
+		Err:     err,
+	}
+}
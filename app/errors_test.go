@@ -0,0 +1,108 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chrisolsen/aetemplate/core"
+	"google.golang.org/appengine"
+)
+
+// problemResponse writes the error's problem document and decodes it
+func problemResponse(t *testing.T, problemErr error) (*httptest.ResponseRecorder, problem) {
+	c := getContext()
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest(http.MethodGet, "/v1/me", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeProblem(c, w, r, problemErr)
+
+	var p problem
+	if err = json.NewDecoder(w.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	if p.RequestID != appengine.RequestID(c) {
+		t.Errorf("expected request id %q, got %q", appengine.RequestID(c), p.RequestID)
+	}
+	return w, p
+}
+
+func TestWriteProblem(t *testing.T) {
+	type data struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}
+
+	tests := []data{
+		data{name: "not found", err: errRouteNotFound, status: http.StatusNotFound, code: "not_found"},
+		data{name: "conflict", err: core.ErrUsernameTaken, status: http.StatusConflict, code: "username_taken"},
+		data{name: "stale", err: core.ErrStaleAccount, status: http.StatusPreconditionFailed, code: "stale_account"},
+		data{name: "upstream", err: core.WrapError(core.Upstream, "provider_unavailable", errors.New("timeout")), status: http.StatusBadGateway, code: "provider_unavailable"},
+		data{name: "internal", err: errors.New("boom"), status: http.StatusInternalServerError, code: "internal_error"},
+	}
+
+	for _, test := range tests {
+		w, p := problemResponse(t, test.err)
+		if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Errorf("%s: expected problem content type, got %s", test.name, ct)
+		}
+		if w.Code != test.status || p.Status != test.status {
+			t.Errorf("%s: expected status %d, got %d with body status %d", test.name, test.status, w.Code, p.Status)
+		}
+		if p.Code != test.code || p.Type != problemTypeBase+test.code {
+			t.Errorf("%s: expected code %s, got %s with type %s", test.name, test.code, p.Code, p.Type)
+		}
+		if p.Instance != "/v1/me" {
+			t.Errorf("%s: expected instance to be the request path, got %s", test.name, p.Instance)
+		}
+	}
+}
+
+func TestWriteProblem_InternalDetail(t *testing.T) {
+	_, p := problemResponse(t, errors.New("connecting to 10.0.0.1: refused"))
+
+	// only the dev server returns the details of unexpected errors
+	if appengine.IsDevAppServer() {
+		if p.Detail != "connecting to 10.0.0.1: refused" {
+			t.Errorf("expected dev server to return the error, got %q", p.Detail)
+		}
+	} else if len(p.Detail) > 0 {
+		t.Errorf("expected internal detail to be hidden, got %q", p.Detail)
+	}
+
+	// expected errors always return their message
+	_, p = problemResponse(t, core.ErrUsernameTaken)
+	if p.Detail != core.ErrUsernameTaken.Message {
+		t.Errorf("expected error message as detail, got %q", p.Detail)
+	}
+}
+
+func TestWriteProblem_Fields(t *testing.T) {
+	err := core.InvalidFields(core.FieldError{Field: "account.email", Code: "invalid_email", Message: "email is not a valid email address"})
+	w, p := problemResponse(t, err)
+	if w.Code != http.StatusBadRequest || p.Code != "invalid_fields" {
+		t.Errorf("expected invalid fields, got %d %s", w.Code, p.Code)
+	}
+	if len(p.Errors) != 1 || p.Errors[0].Field != "account.email" || p.Errors[0].Code != "invalid_email" {
+		t.Errorf("expected field errors, got %+v", p.Errors)
+	}
+}
+
+func TestWriteProblem_RetryAfter(t *testing.T) {
+	w, p := problemResponse(t, &core.ThrottledError{RetryAfter: 1500 * time.Millisecond})
+	if w.Code != http.StatusTooManyRequests || p.Code != "too_many_attempts" || p.Type != problemTypeBase+"too_many_attempts" {
+		t.Errorf("expected too many attempts, got %d %s %s", w.Code, p.Code, p.Type)
+	}
+
+	// rounded up to whole seconds
+	if retry := w.Header().Get("Retry-After"); retry != "2" {
+		t.Errorf("expected retry after 2 seconds, got %q", retry)
+	}
+}
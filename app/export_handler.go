@@ -0,0 +1,161 @@
+package app
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/chrisolsen/ae/handler"
+	"github.com/chrisolsen/aetemplate/core"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/log"
+)
+
+func newExportService() *core.ExportService {
+	return &core.ExportService{
+		Storage:     core.GCSStorage{},
+		Mailer:      mailer,
+		DownloadURL: os.Getenv("EXPORT_DOWNLOAD_URL"),
+	}
+}
+
+// exportAccount builds the account's archive in a task queue task; failed
+// exports are retried unless the account can't be exported
+var exportAccount = delay.Func("exportAccount", func(c context.Context, encodedKey string) error {
+	accountKey, err := datastore.DecodeKey(encodedKey)
+	if err != nil {
+		log.Errorf(c, "decoding export account key: %v", err)
+		return nil
+	}
+
+	err = newExportService().Export(c, accountKey)
+	if err == datastore.ErrNoSuchEntity || core.KindOf(err) == core.Invalid {
+		log.Warningf(c, "skipping export of %s: %v", encodedKey, err)
+		return nil
+	}
+	if err != nil {
+		log.Errorf(c, "exporting account %s: %v", encodedKey, err)
+	}
+	return err
+})
+
+// ExportHandler starts exports of the signed in account's personal data and
+// issues the codes that download them
+type ExportHandler struct {
+	handler.Base
+}
+
+func (h ExportHandler) ServeHTTP(c context.Context, w http.ResponseWriter, r *http.Request) {
+	h.Bind(c, w, r)
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/me/export":
+		h.export()
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/me/export/download-code":
+		h.downloadCode()
+	case r.Method == http.MethodOptions:
+		h.ValidateOrigin(nil)
+	default:
+		abort(&h.Base, errRouteNotFound)
+	}
+}
+
+// export queues the building of the account's archive; the account is emailed
+// once it is ready. Exports can't be requested while the account's latest
+// export is being built or can still be downloaded.
+//
+// 	POST /v1/me/export => [202, 400, 401, 409, 500]
+func (h *ExportHandler) export() {
+	accountKey, err := session.AccountKey(h.Ctx)
+	if err != nil {
+		abort(&h.Base, errSessionAccount(err))
+		return
+	}
+	var me core.Account
+	err = session.Account(h.Ctx, &me)
+	if err != nil {
+		abort(&h.Base, errSessionAccount(err))
+		return
+	}
+	if len(me.Email) == 0 {
+		abort(&h.Base, core.ErrExportMissingEmail)
+		return
+	}
+
+	err = newExportService().Request(h.Ctx, accountKey)
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	err = exportAccount.Call(h.Ctx, accountKey.Encode())
+	if err != nil {
+		abort(&h.Base, core.WrapError(core.Internal, "export_failed", err))
+		return
+	}
+
+	h.Res.WriteHeader(http.StatusAccepted)
+}
+
+// downloadCode returns a code that downloads the account's latest export once,
+// within a few minutes, from /v1/exports
+//
+// 	POST /v1/me/export/download-code => [200, 401, 404, 500]
+// 	{
+// 		"code": "ahFkZXZ...",
+// 		"expiry": "2017-01-01T00:05:00Z"
+// 	}
+func (h *ExportHandler) downloadCode() {
+	accountKey, err := session.AccountKey(h.Ctx)
+	if err != nil {
+		abort(&h.Base, errSessionAccount(err))
+		return
+	}
+
+	token, err := newExportService().DownloadCode(h.Ctx, accountKey)
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	h.ToJSON(&exportDownloadCode{Code: token.Value(), Expiry: token.Expiry})
+}
+
+// exportDownloadCode is exchanged for the archive at /v1/exports
+type exportDownloadCode struct {
+	Code   string    `json:"code"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// ExportDownloadHandler returns the archive for a download code. The code is
+// the only credential, so downloads can be plain links without auth; codes are
+// short-lived and single use since they end up in logs and browser history.
+type ExportDownloadHandler struct {
+	handler.Base
+}
+
+// GET /v1/exports?code=... => [200, 400, 404, 500]
+func (h ExportDownloadHandler) ServeHTTP(c context.Context, w http.ResponseWriter, r *http.Request) {
+	h.Bind(c, w, r)
+	if r.Method != http.MethodGet {
+		abort(&h.Base, errRouteNotFound)
+		return
+	}
+
+	code, ok := h.QueryParam("code")
+	if !ok || len(code) == 0 {
+		abort(&h.Base, errRequired("code"))
+		return
+	}
+
+	data, err := newExportService().Download(c, code)
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="export.zip"`)
+	w.Write(data)
+}
@@ -0,0 +1,90 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/chrisolsen/ae/handler"
+	"github.com/chrisolsen/aetemplate/core"
+	"golang.org/x/net/context"
+)
+
+// PasswordHandler recovers forgotten username / password credentials
+type PasswordHandler struct {
+	handler.Base
+}
+
+func (h PasswordHandler) ServeHTTP(c context.Context, w http.ResponseWriter, r *http.Request) {
+	h.Bind(c, w, r)
+	svc := core.PasswordService{
+		Mailer:   mailer,
+		ResetURL: os.Getenv("PASSWORD_RESET_URL"),
+	}
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/password/forgot":
+		h.forgot(&svc)
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/password/reset":
+		h.reset(&svc)
+	case r.Method == http.MethodOptions:
+		h.ValidateOrigin(nil)
+	default:
+		abort(&h.Base, errRouteNotFound)
+	}
+}
+
+// forgot emails a reset link to the owner of the username. The response is the
+// same whether or not the username exists.
+//
+// 	POST /v1/password/forgot => [202, 400, 500]
+// 	{
+// 		"username": "bob@example.com"
+// 	}
+func (h *PasswordHandler) forgot(svc *core.PasswordService) {
+	var body struct {
+		Username string `json:"username"`
+	}
+	err := json.NewDecoder(h.Req.Body).Decode(&body)
+	if err != nil || len(body.Username) == 0 {
+		abort(&h.Base, errRequired("username"))
+		return
+	}
+
+	err = svc.Forgot(h.Ctx, body.Username)
+	if err != nil {
+		abort(&h.Base, fmt.Errorf("sending reset link: %v", err))
+		return
+	}
+
+	h.Res.WriteHeader(http.StatusAccepted)
+}
+
+// reset sets the new password with the emailed reset token. All of the
+// account's existing auth tokens are revoked.
+//
+// 	POST /v1/password/reset => [204, 400, 500]
+// 	{
+// 		"token": "ahFkZXZ...",
+// 		"password": "foobario"
+// 	}
+func (h *PasswordHandler) reset(svc *core.PasswordService) {
+	var body struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	err := json.NewDecoder(h.Req.Body).Decode(&body)
+	if err != nil {
+		abort(&h.Base, errInvalidBody(err))
+		return
+	}
+
+	err = svc.Reset(h.Ctx, body.Token, body.Password)
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	h.Res.WriteHeader(http.StatusNoContent)
+}
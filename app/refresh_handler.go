@@ -0,0 +1,94 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/chrisolsen/ae/handler"
+	"github.com/chrisolsen/aetemplate/core"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// RefreshHandler exchanges a refresh token for a new access token
+type RefreshHandler struct {
+	handler.Base
+}
+
+func (h RefreshHandler) ServeHTTP(c context.Context, w http.ResponseWriter, r *http.Request) {
+	h.Bind(c, w, r)
+	switch r.Method {
+	case http.MethodPost:
+		h.refresh()
+	case http.MethodOptions:
+		h.ValidateOrigin(nil)
+	default:
+		abort(&h.Base, errRouteNotFound)
+	}
+}
+
+// refresh returns a new access token for the refresh token. The refresh token
+// is rotated when it is close to expiring, in which case the new refresh token
+// is returned in place of the submitted one.
+//
+// 	200 - refreshed
+// 	400 - bad request / stateless access tokens not enabled
+// 	401 - invalid or expired refresh token
+//
+// 	POST /v1/auth/refresh
+// 	{
+// 		"refreshToken": "ahFkZXZ..."
+// 	}
+func (h *RefreshHandler) refresh() {
+	if accessTokens == nil {
+		abort(&h.Base, core.NewError(core.Invalid, "access_tokens_disabled", "access tokens are not enabled"))
+		return
+	}
+
+	var body struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	err := json.NewDecoder(h.Req.Body).Decode(&body)
+	if err != nil || len(body.RefreshToken) == 0 {
+		abort(&h.Base, errRequired("refreshToken"))
+		return
+	}
+
+	details, err := authMiddleware.getTokenDetails(h.Ctx, body.RefreshToken)
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+	if details.isExpired() {
+		abort(&h.Base, errExpiredToken)
+		return
+	}
+
+	accountKey, err := datastore.DecodeKey(details.AccountKey)
+	if err != nil {
+		abort(&h.Base, errInvalidAuthToken(err))
+		return
+	}
+
+	refreshToken, expiry := body.RefreshToken, details.Expiry
+	if details.needsRotation() {
+		newToken, newExpiry, err := authMiddleware.rotateToken(h.Ctx, details, body.RefreshToken, h.Req)
+		if err != nil {
+			abort(&h.Base, errInvalidAuthToken(err))
+			return
+		}
+		if len(newToken) > 0 {
+			refreshToken, expiry = newToken, newExpiry
+		}
+	}
+
+	authMiddleware.touchToken(h.Ctx, details)
+
+	res, err := newTokenResponse(accountKey, refreshToken, expiry)
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	h.ToJSON(res)
+}
@@ -0,0 +1,128 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/chrisolsen/ae/handler"
+	"github.com/chrisolsen/aetemplate/core"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+const sessionsPath = "/v1/me/sessions"
+
+var errSessionNotFound = core.NewError(core.NotFound, "session_not_found", "session not found")
+
+// SessionsHandler lists and signs out the account's active tokens
+type SessionsHandler struct {
+	handler.Base
+}
+
+// sessionInfo is the public view of a token; the token value is never exposed
+type sessionInfo struct {
+	ID         string    `json:"id"`
+	IssuedAt   time.Time `json:"issuedAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	Expiry     time.Time `json:"expiry"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	Current    bool      `json:"current"`
+}
+
+func (h SessionsHandler) ServeHTTP(c context.Context, w http.ResponseWriter, r *http.Request) {
+	h.Bind(c, w, r)
+	switch r.Method {
+	case http.MethodGet:
+		h.list()
+	case http.MethodDelete:
+		h.revoke()
+	case http.MethodOptions:
+		h.ValidateOrigin(nil)
+	default:
+		abort(&h.Base, errRouteNotFound)
+	}
+}
+
+// GET /v1/me/sessions => [200, 500]
+func (h *SessionsHandler) list() {
+	accountKey, err := session.AccountKey(h.Ctx)
+	if err != nil {
+		abort(&h.Base, errSessionAccount(err))
+		return
+	}
+
+	tokens, err := TokenStore.GetByAccount(h.Ctx, accountKey)
+	if err != nil {
+		abort(&h.Base, fmt.Errorf("getting tokens: %v", err))
+		return
+	}
+
+	// flag the token used for this request
+	var currentKey *datastore.Key
+	if rawToken, err := headerToken(h.Req); err == nil {
+		currentKey, _, _ = core.ParseToken(h.Ctx, rawToken)
+	}
+
+	now := time.Now()
+	sessions := []sessionInfo{}
+	for _, t := range tokens {
+		if t.Expiry.Before(now) {
+			continue
+		}
+		sessions = append(sessions, sessionInfo{
+			ID:         t.ID(),
+			IssuedAt:   t.IssuedAt,
+			LastUsedAt: t.LastUsedAt,
+			Expiry:     t.Expiry,
+			UserAgent:  t.UserAgent,
+			IP:         t.IP,
+			Current:    currentKey != nil && currentKey.Equal(t.Key),
+		})
+	}
+
+	h.ToJSON(sessions)
+}
+
+// DELETE /v1/me/sessions/{id} => [204, 400, 404, 500]
+func (h *SessionsHandler) revoke() {
+	id := strings.TrimPrefix(h.Req.URL.Path, sessionsPath+"/")
+	if len(id) == 0 || id == h.Req.URL.Path {
+		abort(&h.Base, errRequired("id"))
+		return
+	}
+
+	accountKey, err := session.AccountKey(h.Ctx)
+	if err != nil {
+		abort(&h.Base, errSessionAccount(err))
+		return
+	}
+
+	tokenKey, err := TokenStore.KeyFromID(h.Ctx, accountKey, id)
+	if err != nil {
+		abort(&h.Base, errSessionNotFound)
+		return
+	}
+
+	// tokens are children of the account, so other accounts' tokens can't be found
+	var token core.Token
+	err = TokenStore.Get(h.Ctx, tokenKey, &token)
+	if err == datastore.ErrNoSuchEntity {
+		abort(&h.Base, errSessionNotFound)
+		return
+	}
+	if err != nil {
+		abort(&h.Base, fmt.Errorf("getting token: %v", err))
+		return
+	}
+
+	err = TokenStore.Revoke(h.Ctx, tokenKey)
+	if err != nil {
+		abort(&h.Base, fmt.Errorf("revoking token: %v", err))
+		return
+	}
+
+	h.Res.WriteHeader(http.StatusNoContent)
+}
@@ -4,10 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/chrisolsen/ae/handler"
 	"github.com/chrisolsen/aetemplate/core"
 	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
 )
 
 // SignupHandler .
@@ -18,17 +20,22 @@ type SignupHandler struct {
 func (h SignupHandler) ServeHTTP(c context.Context, w http.ResponseWriter, r *http.Request) {
 	h.Bind(c, w, r)
 
+	svc := core.AuthService{
+		URLGetter: core.AppEngineURLGetter{Ctx: c},
+		Providers: authProviders,
+	}
+
 	switch r.Method {
 	case http.MethodPost:
-		h.createAccount()
+		h.createAccount(svc.Verify)
 	case http.MethodOptions:
 		h.ValidateOrigin([]string{"http://your_domain.com"})
 	default:
-		h.Abort(http.StatusNotFound, nil)
+		abort(&h.Base, errRouteNotFound)
 	}
 }
 
-// POST /v1/signup => [201, 400, 500]
+// POST /v1/signup => [201, 400, 401, 409, 500]
 //  {
 //  	account: {
 //  		firstName: "jim",
@@ -36,14 +43,14 @@ func (h SignupHandler) ServeHTTP(c context.Context, w http.ResponseWriter, r *ht
 //  	},
 //  	credentials: {
 //  		providerId: "234324523",
-//  		providerName: "facebook",
+//  		providerName: "facebook",		// or google, oidc
 //  		providerToken: "9q8763w4iwqr",
 //
 //			username: "bob@example.com",
 // 			password: "foobario"
 //  	}
 //  }
-func (h *SignupHandler) createAccount() {
+func (h *SignupHandler) createAccount(verify core.VerifyFunc) {
 	type data struct {
 		Account     core.Account     `json:"account"`
 		Credentials core.Credentials `json:"credentials"`
@@ -52,21 +59,71 @@ func (h *SignupHandler) createAccount() {
 	var input data
 	err := json.NewDecoder(h.Req.Body).Decode(&input)
 	if err != nil {
-		h.Abort(http.StatusBadRequest, fmt.Errorf("decoding req body: %v", err))
+		abort(&h.Base, errInvalidBody(err))
+		return
+	}
+
+	// checked before the provider is called, so oversized or missing values
+	// aren't sent to it
+	err = core.ValidateAll(map[string]core.Validator{"credentials": &input.Credentials})
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	// provider tokens must be verified before they are linked to an account
+	if len(input.Credentials.ProviderName) > 0 {
+		identity, err := verify(h.Ctx, &input.Credentials)
+		if err != nil {
+			abort(&h.Base, err)
+			return
+		}
+		if len(input.Account.Email) == 0 {
+			input.Account.Email = identity.Email
+		}
+		if len(input.Account.Name) == 0 {
+			input.Account.Name = identity.Name
+		}
+	}
+
+	// validated after the provider's values are filled in, since they aren't
+	// trusted either
+	err = core.ValidateAll(map[string]core.Validator{"account": &input.Account})
+	if err != nil {
+		abort(&h.Base, err)
 		return
 	}
 
+	// verification is confirmed through the emailed code only
+	input.Account.EmailVerified = time.Time{}
+	// set by the server only
+	input.Account.Admin = false
+	input.Account.Status = ""
+	input.Account.Photo = core.Attachment{}
+
 	accountKey, err := AccountStore.Create(h.Ctx, &input.Credentials, &input.Account)
 	if err != nil {
-		h.Abort(http.StatusInternalServerError, fmt.Errorf("creating account: %v", err))
+		abort(&h.Base, err)
+		return
+	}
+
+	// a failed email shouldn't fail the signup; it can be resent
+	err = newEmailVerifier().Start(h.Ctx, accountKey)
+	if err != nil {
+		log.Errorf(h.Ctx, "sending verification email: %v", err)
+	}
+
+	token, err := TokenStore.Create(h.Ctx, accountKey, requestDevice(h.Req))
+	if err != nil {
+		abort(&h.Base, fmt.Errorf("creating token: %v", err))
 		return
 	}
 
-	token, err := TokenStore.Create(h.Ctx, accountKey)
+	res, err := newTokenResponse(accountKey, token.Value(), token.Expiry)
 	if err != nil {
-		h.Abort(http.StatusInternalServerError, fmt.Errorf("creating token: %v", err))
+		abort(&h.Base, err)
 		return
 	}
 
-	h.ToJSONWithStatus(token, http.StatusCreated)
+	h.ToJSONWithStatus(res, http.StatusCreated)
 }
@@ -0,0 +1,30 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSignupHandler_DuplicateUsername(t *testing.T) {
+	c := getContext()
+
+	signup := func() *httptest.ResponseRecorder {
+		body := `{"account": {"name": "dup"}, "credentials": {"username": "duplicate", "password": "foobario"}}`
+		r, err := http.NewRequest(http.MethodPost, "/v1/signup", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		SignupHandler{}.ServeHTTP(c, w, r)
+		return w
+	}
+
+	if w := signup(); w.Code != http.StatusCreated {
+		t.Fatalf("expected signup to succeed, got %d: %s", w.Code, w.Body)
+	}
+	if w := signup(); w.Code != http.StatusConflict {
+		t.Errorf("expected duplicate username to conflict, got %d: %s", w.Code, w.Body)
+	}
+}
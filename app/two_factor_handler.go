@@ -0,0 +1,247 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+
+	"github.com/chrisolsen/ae/handler"
+	"github.com/chrisolsen/aetemplate/core"
+	"golang.org/x/net/context"
+)
+
+func newTwoFactorService() core.TwoFactorService {
+	return core.TwoFactorService{Issuer: os.Getenv("TWO_FACTOR_ISSUER"), Throttle: loginThrottle}
+}
+
+// errTwoFactorFailed is returned when the second factor of a sign in is
+// invalid; it fails the sign in like invalid credentials do
+var errTwoFactorFailed = core.NewError(core.Unauthorized, "invalid_two_factor_code", "invalid two-factor code")
+
+// twoFactorCode is the request body containing a TOTP or recovery code
+type twoFactorCode struct {
+	Code string `json:"code"`
+}
+
+// TwoFactorHandler manages the signed in account's second factor
+type TwoFactorHandler struct {
+	handler.Base
+}
+
+func (h TwoFactorHandler) ServeHTTP(c context.Context, w http.ResponseWriter, r *http.Request) {
+	h.Bind(c, w, r)
+	svc := newTwoFactorService()
+
+	if r.Method == http.MethodOptions {
+		h.ValidateOrigin(nil)
+		return
+	}
+	if r.Method != http.MethodPost {
+		abort(&h.Base, errRouteNotFound)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/v1/me/2fa/enroll":
+		h.enroll(svc)
+	case "/v1/me/2fa/confirm":
+		h.confirm(svc)
+	case "/v1/me/2fa/disable":
+		h.disable(svc)
+	case "/v1/me/2fa/recovery-codes":
+		h.regenerateRecoveryCodes(svc)
+	default:
+		abort(&h.Base, errRouteNotFound)
+	}
+}
+
+// enroll creates the TOTP secret that is added to an authenticator app. Two
+// factor authentication isn't required until the first code is confirmed.
+//
+// 	POST /v1/me/2fa/enroll => [200, 409, 500]
+// 	{
+// 		"secret": "JBSWY3DPEHPK3PXP...",
+// 		"uri": "otpauth://totp/..."
+// 	}
+func (h *TwoFactorHandler) enroll(svc core.TwoFactorService) {
+	var account core.Account
+	err := session.Account(h.Ctx, &account)
+	if err != nil {
+		abort(&h.Base, errSessionAccount(err))
+		return
+	}
+
+	name := account.Email
+	if len(name) == 0 {
+		name = account.Name
+	}
+
+	enrollment, err := svc.Enroll(h.Ctx, account.Key, name)
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	h.ToJSON(enrollment)
+}
+
+// confirm enables two factor authentication with the first code from the
+// authenticator app and returns the recovery codes, which aren't shown again
+//
+// 	POST /v1/me/2fa/confirm => [200, 400, 409, 500]
+// 	{
+// 		"code": "123456"
+// 	}
+func (h *TwoFactorHandler) confirm(svc core.TwoFactorService) {
+	code, ok := h.code()
+	if !ok {
+		return
+	}
+
+	accountKey, err := session.AccountKey(h.Ctx)
+	if err != nil {
+		abort(&h.Base, errSessionAccount(err))
+		return
+	}
+
+	codes, err := svc.Confirm(h.Ctx, accountKey, code)
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	h.ToJSON(map[string][]string{"recoveryCodes": codes})
+}
+
+// disable turns off two factor authentication with a code or recovery code
+//
+// 	POST /v1/me/2fa/disable => [204, 400, 409, 429, 500]
+// 	{
+// 		"code": "123456"
+// 	}
+func (h *TwoFactorHandler) disable(svc core.TwoFactorService) {
+	code, ok := h.code()
+	if !ok {
+		return
+	}
+
+	accountKey, err := session.AccountKey(h.Ctx)
+	if err != nil {
+		abort(&h.Base, errSessionAccount(err))
+		return
+	}
+
+	err = svc.Disable(h.Ctx, accountKey, code)
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	h.Res.WriteHeader(http.StatusNoContent)
+}
+
+// regenerateRecoveryCodes replaces the recovery codes
+//
+// 	POST /v1/me/2fa/recovery-codes => [200, 400, 409, 429, 500]
+// 	{
+// 		"code": "123456"
+// 	}
+func (h *TwoFactorHandler) regenerateRecoveryCodes(svc core.TwoFactorService) {
+	code, ok := h.code()
+	if !ok {
+		return
+	}
+
+	accountKey, err := session.AccountKey(h.Ctx)
+	if err != nil {
+		abort(&h.Base, errSessionAccount(err))
+		return
+	}
+
+	codes, err := svc.RegenerateRecoveryCodes(h.Ctx, accountKey, code)
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	h.ToJSON(map[string][]string{"recoveryCodes": codes})
+}
+
+// code decodes the code from the request body, aborting when it is missing
+func (h *TwoFactorHandler) code() (string, bool) {
+	var body twoFactorCode
+	err := json.NewDecoder(h.Req.Body).Decode(&body)
+	if err != nil || len(body.Code) == 0 {
+		abort(&h.Base, errRequired("code"))
+		return "", false
+	}
+	return body.Code, true
+}
+
+// TwoFactorAuthHandler exchanges a second factor challenge for an auth token
+type TwoFactorAuthHandler struct {
+	handler.Base
+}
+
+func (h TwoFactorAuthHandler) ServeHTTP(c context.Context, w http.ResponseWriter, r *http.Request) {
+	h.Bind(c, w, r)
+	svc := core.AuthService{
+		Device:    requestDevice(r),
+		TwoFactor: newTwoFactorService(),
+		Throttle:  loginThrottle,
+	}
+	switch r.Method {
+	case http.MethodPost:
+		h.complete(svc.CompleteTwoFactor)
+	case http.MethodOptions:
+		h.ValidateOrigin(nil)
+	default:
+		abort(&h.Base, errRouteNotFound)
+	}
+}
+
+// complete returns the auth token once the challenge returned by /v1/auth and
+// a code are validated. Challenges are discarded after too many invalid codes.
+//
+// 	200 - authenticated
+// 	400 - bad request
+// 	401 - invalid code or challenge
+// 	429 - too many failed attempts; retry after the Retry-After seconds
+//
+// 	POST /v1/auth/2fa
+// 	{
+// 		"challenge": "ahFkZXZ...",
+// 		"code": "123456"
+// 	}
+func (h *TwoFactorAuthHandler) complete(completeTwoFactor func(c context.Context, challenge, code string) (*core.Token, error)) {
+	var body struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+	err := json.NewDecoder(h.Req.Body).Decode(&body)
+	if err != nil || len(body.Challenge) == 0 {
+		abort(&h.Base, errRequired("challenge"))
+		return
+	}
+	if len(body.Code) == 0 {
+		abort(&h.Base, errRequired("code"))
+		return
+	}
+
+	token, err := completeTwoFactor(h.Ctx, body.Challenge, body.Code)
+	if err == core.ErrInvalidTwoFactorCode {
+		err = errTwoFactorFailed
+	}
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	res, err := newTokenResponse(token.Key.Parent(), token.Value(), token.Expiry)
+	if err != nil {
+		abort(&h.Base, err)
+		return
+	}
+
+	h.ToJSON(res)
+}
@@ -0,0 +1,33 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/chrisolsen/aetemplate/core"
+	"golang.org/x/net/context"
+)
+
+func TestTwoFactorAuthHandler_InvalidCode(t *testing.T) {
+	c := getContext()
+	r, err := http.NewRequest(http.MethodPost, "/v1/auth/2fa", strings.NewReader(`{"challenge": "challenge", "code": "000000"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	h := TwoFactorAuthHandler{}
+	h.Bind(c, w, r)
+	h.complete(func(c context.Context, challenge, code string) (*core.Token, error) {
+		return nil, core.ErrInvalidTwoFactorCode
+	})
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected invalid code to fail the sign in, got %d: %s", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), `"code":"invalid_two_factor_code"`) {
+		t.Errorf("expected invalid code problem, got %s", w.Body)
+	}
+}
@@ -0,0 +1,122 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// DefaultAccessTokenTTL is how long access tokens are valid when the signer
+// doesn't specify
+const DefaultAccessTokenTTL = time.Minute * 15
+
+// ErrInvalidAccessToken is returned when an access token is malformed, has an
+// invalid signature or has expired
+var ErrInvalidAccessToken = NewError(Unauthorized, "invalid_access_token", "invalid access token")
+
+// AccessTokenSigner issues short-lived HS256 signed access tokens that can be
+// verified without a storage lookup. They are paired with a longer-lived
+// refresh Token that is exchanged for new access tokens.
+//
+// Each key has an id which is included in the token header, so tokens signed
+// with a previous key continue to verify while keys are rotated.
+type AccessTokenSigner struct {
+	// Keys are the HMAC keys accepted for verification, by key id
+	Keys map[string][]byte
+	// KeyID is the id of the key new tokens are signed with
+	KeyID string
+	TTL   time.Duration
+	Clock Clock
+}
+
+type accessTokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+type accessTokenClaims struct {
+	Subject  string `json:"sub"`
+	IssuedAt int64  `json:"iat"`
+	Expiry   int64  `json:"exp"`
+}
+
+// Sign creates an access token for the account
+func (s *AccessTokenSigner) Sign(accountKey *datastore.Key) (string, time.Time, error) {
+	key, ok := s.Keys[s.KeyID]
+	if !ok {
+		return "", time.Time{}, fmt.Errorf("access token signing key %q not found", s.KeyID)
+	}
+
+	ttl := s.TTL
+	if ttl <= 0 {
+		ttl = DefaultAccessTokenTTL
+	}
+	now := s.Clock.Now()
+	expiry := now.Add(ttl)
+
+	header, err := json.Marshal(accessTokenHeader{Alg: "HS256", Typ: "JWT", Kid: s.KeyID})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	claims, err := json.Marshal(accessTokenClaims{
+		Subject:  accountKey.Encode(),
+		IssuedAt: now.Unix(),
+		Expiry:   expiry.Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signHS256(key, signed)), expiry, nil
+}
+
+// Verify validates the access token's signature and expiry and returns the
+// key of the account it was issued to
+func (s *AccessTokenSigner) Verify(token string) (*datastore.Key, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidAccessToken
+	}
+
+	var header accessTokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return nil, ErrInvalidAccessToken
+	}
+	key, ok := s.Keys[header.Kid]
+	if !ok {
+		return nil, ErrInvalidAccessToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, signHS256(key, parts[0]+"."+parts[1])) {
+		return nil, ErrInvalidAccessToken
+	}
+
+	var claims accessTokenClaims
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidAccessToken
+	}
+	if !s.Clock.Now().Before(time.Unix(claims.Expiry, 0)) {
+		return nil, ErrInvalidAccessToken
+	}
+
+	accountKey, err := datastore.DecodeKey(claims.Subject)
+	if err != nil {
+		return nil, ErrInvalidAccessToken
+	}
+	return accountKey, nil
+}
+
+func signHS256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,80 @@
+package core
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+func TestAccessTokenSigner(t *testing.T) {
+	c := getContext()
+	accountKey := datastore.NewKey(c, "accounts", "access", 0, nil)
+
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	oldSigner := AccessTokenSigner{
+		Keys:  map[string][]byte{"k1": []byte("old-key")},
+		KeyID: "k1",
+		Clock: clock,
+	}
+	signer := AccessTokenSigner{
+		Keys:  map[string][]byte{"k1": []byte("old-key"), "k2": []byte("new-key")},
+		KeyID: "k2",
+		TTL:   time.Minute * 5,
+		Clock: clock,
+	}
+
+	token, expiry, err := signer.Sign(accountKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expiry.Equal(now.Add(time.Minute * 5)) {
+		t.Errorf("unexpected expiry %v", expiry)
+	}
+	oldToken, _, err := oldSigner.Sign(accountKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(token, ".")
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"other","exp":9999999999}`)) + "." + parts[2]
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"k2"}`)) + "." + parts[1] + "."
+
+	type accessTest struct {
+		name   string
+		token  string
+		signer AccessTokenSigner
+		ok     bool
+	}
+	expired := signer
+	expired.Clock = func() time.Time { return now.Add(time.Hour) }
+	rotatedOut := AccessTokenSigner{Keys: map[string][]byte{"k2": []byte("new-key")}, KeyID: "k2", Clock: clock}
+
+	tests := []accessTest{
+		{name: "valid", token: token, signer: signer, ok: true},
+		{name: "signed with previous key", token: oldToken, signer: signer, ok: true},
+		{name: "previous key removed", token: oldToken, signer: rotatedOut},
+		{name: "expired", token: token, signer: expired},
+		{name: "tampered claims", token: tampered, signer: signer},
+		{name: "unsigned", token: unsigned, signer: signer},
+		{name: "malformed", token: "foo", signer: signer},
+	}
+
+	for _, test := range tests {
+		key, err := test.signer.Verify(test.token)
+		if test.ok && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: expected error", test.name)
+			continue
+		}
+		if test.ok && !key.Equal(accountKey) {
+			t.Errorf("%s: unexpected account key %v", test.name, key)
+		}
+	}
+}
@@ -1,19 +1,39 @@
 package core
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/chrisolsen/ae/model"
 	"github.com/chrisolsen/ae/store"
-	"github.com/chrisolsen/async"
 	"golang.org/x/net/context"
+	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
 )
 
 const accountsTable string = "accounts"
 
+// Account statuses
+const (
+	AccountActive = "active"
+	// soft deleted; restorable until DeleteAfter
+	AccountPendingDeletion = "pendingDeletion"
+	// being hard deleted; no longer restorable
+	accountPurging = "purging"
+)
+
+// AccountStatuses are the statuses accounts can be filtered by
+var AccountStatuses = []string{AccountActive, AccountPendingDeletion}
+
+// ErrStaleAccount is returned when an account update is based on an outdated
+// version of the account
+var ErrStaleAccount = NewError(Conflict, "stale_account", "the account has changed since it was fetched")
+
 // AccountPayload contains the account and related data
 type AccountPayload struct {
 	Account
@@ -31,12 +51,127 @@ type Account struct {
 	Locale    string `json:"locale" datastore:",noindex"`
 	Location  string `json:"location" datastore:",noindex"`
 	Name      string `json:"name" datastore:",noindex"`
-	Timezone  int    `json:"timezone" datastore:",noindex"`
+	Timezone  string `json:"timezone" datastore:",noindex"` // IANA name, such as America/Edmonton
 	Email     string `json:"email"`
+	// set once the owner confirms they received the verification email
+	EmailVerified time.Time `json:"emailVerified" datastore:",noindex"`
+	// incremented each time the account is saved; used for optimistic concurrency
+	Version int64 `json:"-" datastore:",noindex"`
+	// Status is one of the AccountStatuses; accounts saved before it existed are
+	// blank until they are saved again or backfilled
+	Status  string    `json:"status"`
+	Created time.Time `json:"created"`
+	// when an account pending deletion is purged
+	DeleteAfter time.Time `json:"deleteAfter,omitempty"`
+	// set by admins only; grants access to the /v1/admin APIs
+	Admin bool `json:"admin" datastore:",noindex"`
 
 	Photo Attachment `json:"photo"`
 }
 
+// Validate trims the account's values, normalizes its email and checks each
+// field, returning an Invalid error listing the invalid fields
+func (a *Account) Validate() error {
+	a.FirstName = strings.TrimSpace(a.FirstName)
+	a.LastName = strings.TrimSpace(a.LastName)
+	a.Name = strings.TrimSpace(a.Name)
+	a.Location = strings.TrimSpace(a.Location)
+	a.Email = NormalizeEmail(a.Email)
+
+	v := validator{}
+	v.maxLength("firstName", a.FirstName, MaxNameLength)
+	v.maxLength("lastName", a.LastName, MaxNameLength)
+	v.maxLength("name", a.Name, MaxNameLength)
+	v.maxLength("location", a.Location, MaxLocationLength)
+	if len(a.Email) > 0 {
+		v.email("email", a.Email)
+	}
+	if len(a.Gender) > 0 {
+		v.oneOf("gender", a.Gender, Genders)
+	}
+	if len(a.Locale) > 0 {
+		v.locale("locale", a.Locale)
+	}
+	if len(a.Timezone) > 0 {
+		v.timezone("timezone", a.Timezone)
+	}
+	return v.err()
+}
+
+// Load loads the account, converting the hour offsets from UTC that were saved
+// before timezones were IANA names to the matching Etc/GMT zone. Offsets of
+// zero were never set, so they are left blank.
+func (a *Account) Load(props []datastore.Property) error {
+	for i, p := range props {
+		if offset, ok := p.Value.(int64); ok && p.Name == "Timezone" {
+			props[i].Value = legacyTimezone(offset)
+		}
+	}
+	return datastore.LoadStruct(a, props)
+}
+
+// legacyTimezone returns the Etc/GMT zone of the hour offset from UTC, whose
+// sign is inverted in the zone's name, or blank if there isn't one
+func legacyTimezone(offset int64) string {
+	if offset == 0 || offset < -12 || offset > 14 {
+		return ""
+	}
+	return fmt.Sprintf("Etc/GMT%+d", -offset)
+}
+
+// Save saves the account as its next version
+func (a *Account) Save() ([]datastore.Property, error) {
+	a.Version++
+	if len(a.Status) == 0 {
+		a.Status = AccountActive
+	}
+	return datastore.SaveStruct(a)
+}
+
+// editableFields returns the fields owners can change, by their JSON names
+func (a *Account) editableFields() map[string]*string {
+	return map[string]*string{
+		"firstName": &a.FirstName,
+		"lastName":  &a.LastName,
+		"name":      &a.Name,
+		"gender":    &a.Gender,
+		"locale":    &a.Locale,
+		"location":  &a.Location,
+		"timezone":  &a.Timezone,
+		"email":     &a.Email,
+	}
+}
+
+// ApplyPatch applies the JSON merge patch (RFC 7386) to the account's editable
+// fields; null values clear the field. Fields that don't exist or can't be
+// edited are rejected rather than ignored.
+func (a *Account) ApplyPatch(patch map[string]json.RawMessage) error {
+	var names []string
+	for name := range patch {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	v := validator{}
+	fields := a.editableFields()
+	for _, name := range names {
+		field, ok := fields[name]
+		if !ok {
+			v.add(name, "not_editable", fmt.Sprintf("%s can't be changed", name))
+			continue
+		}
+		if string(patch[name]) == "null" {
+			*field = ""
+			continue
+		}
+		err := json.Unmarshal(patch[name], field)
+		if err != nil {
+			v.add(name, "invalid_type", fmt.Sprintf("%s must be a string", name))
+		}
+	}
+	return v.err()
+}
+
 type AccountStore struct {
 	store.Base
 }
@@ -47,47 +182,157 @@ func NewAccountStore() AccountStore {
 	return s
 }
 
-// Create creates a new account and creates its default subscriptions
+// Create creates a new account and creates its default subscriptions. The
+// email and username are reserved in the same transaction, so ErrEmailTaken,
+// ErrUsernameTaken or ErrCredentialsInUse is returned if another account
+// already uses them. New passwords must be at least MinPasswordLength long.
 func (s *AccountStore) Create(c context.Context, creds *Credentials, account *Account) (*datastore.Key, error) {
+	if len(creds.ProviderID) == 0 && len(creds.Password) < MinPasswordLength {
+		return nil, ErrWeakPassword
+	}
+
 	var err error
 	var accountKey *datastore.Key
 	var cStore = NewCredentialStore()
+	var rStore = NewReservationStore()
+	account.Created = time.Now()
 	err = datastore.RunInTransaction(c, func(tc context.Context) error {
 		accountKey, err = s.Base.Create(tc, account, nil)
 		if err != nil {
 			return fmt.Errorf("failed to create account: %v", err)
 		}
 
+		if len(account.Email) > 0 {
+			err = rStore.Reserve(tc, accountKey, ReserveEmail, account.Email)
+			if err != nil {
+				return err
+			}
+		}
+
+		// classified errors, such as ErrUsernameTaken, are returned as is so
+		// their kind isn't lost
 		_, err = cStore.Create(tc, creds, accountKey)
+		if _, ok := err.(*Error); ok {
+			return err
+		}
 		if err != nil {
 			return fmt.Errorf("failed to create credentials: %v", err)
 		}
 
 		return nil
 	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return nil, err
+	}
 
 	return accountKey, nil
 }
 
-// GetAccountKeyByCredentials fetches the account matching the auth provider credentials
-func (s *AccountStore) GetAccountKeyByCredentials(c context.Context, creds *Credentials) (*datastore.Key, error) {
-	var err error
-	cstore := NewCredentialStore()
-	// on initial signup the account key will exist within the credentials
-	if creds.AccountKey != nil {
-		var accountCreds []*Credentials
-		_, err = cstore.GetByParent(c, creds.AccountKey, &accountCreds)
+// UpdateEmail changes the account's email, reserving the new email and
+// releasing the old one. ErrEmailTaken is returned if another account uses it.
+func (s *AccountStore) UpdateEmail(c context.Context, accountKey *datastore.Key, email string) error {
+	return datastore.RunInTransaction(c, func(tc context.Context) error {
+		var account Account
+		err := datastore.Get(tc, accountKey, &account)
+		if err != nil {
+			return err
+		}
+		if account.Email == email {
+			return nil
+		}
+
+		err = s.changeEmail(tc, accountKey, account.Email, email)
+		if err != nil {
+			return err
+		}
+
+		account.Email = email
+		_, err = datastore.Put(tc, accountKey, &account)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+// Patch applies the JSON merge patch to the account and validates the result.
+// ErrStaleAccount is returned unless the account's version matches; a negative
+// version skips the check. Email changes are reserved and clear the account's
+// verified state.
+func (s *AccountStore) Patch(c context.Context, accountKey *datastore.Key, version int64, patch map[string]json.RawMessage) (*Account, error) {
+	var account Account
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		account = Account{}
+		err := datastore.Get(tc, accountKey, &account)
+		if err != nil {
+			return err
+		}
+		if version >= 0 && account.Version != version {
+			return ErrStaleAccount
+		}
+
+		email := account.Email
+		err = account.ApplyPatch(patch)
+		if err != nil {
+			return err
+		}
+		err = account.Validate()
 		if err != nil {
-			return nil, fmt.Errorf("failed to find credentials by parent account: %v", err)
+			return err
 		}
-		// validate credentials
-		for _, ac := range accountCreds {
-			if ac.ProviderID == creds.ProviderID && ac.ProviderName == creds.ProviderName {
-				return creds.AccountKey, nil
+
+		// changes in case only don't need to be verified again
+		if normalizeReserved(account.Email) != normalizeReserved(email) {
+			err = s.changeEmail(tc, accountKey, email, account.Email)
+			if err != nil {
+				return err
 			}
+			account.EmailVerified = time.Time{}
+		}
+
+		_, err = datastore.Put(tc, accountKey, &account)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return nil, err
+	}
+
+	account.Key = accountKey
+	return &account, nil
+}
+
+// changeEmail reserves the new email and releases the old one; must be run
+// within a cross group transaction
+func (s *AccountStore) changeEmail(c context.Context, accountKey *datastore.Key, oldEmail, newEmail string) error {
+	rStore := NewReservationStore()
+	if len(newEmail) > 0 {
+		err := rStore.Reserve(c, accountKey, ReserveEmail, newEmail)
+		if err != nil {
+			return err
 		}
-		return nil, errors.New("no matching credentials found for account")
 	}
+	if len(oldEmail) > 0 && normalizeReserved(oldEmail) != normalizeReserved(newEmail) {
+		return rStore.Release(c, accountKey, ReserveEmail, oldEmail)
+	}
+	return nil
+}
+
+// Delete deletes the account and releases its reserved email and usernames
+func (s *AccountStore) Delete(c context.Context, accountKey *datastore.Key) error {
+	rStore := NewReservationStore()
+	err := rStore.ReleaseAll(c, accountKey)
+	if err != nil {
+		return fmt.Errorf("releasing reservations: %v", err)
+	}
+	return s.Base.Delete(c, accountKey)
+}
+
+// errCredentialsNotFound is returned when no single credentials match the username
+var errCredentialsNotFound = NewError(NotFound, "credentials_not_found", "unable to find unique credentials")
+
+// GetAccountKeyByCredentials fetches the account matching the auth provider
+// credentials. errProviderNotFound, errCredentialsNotFound or
+// errPasswordMismatch are returned when they don't match an account.
+func (s *AccountStore) GetAccountKeyByCredentials(c context.Context, creds *Credentials) (*datastore.Key, error) {
+	var err error
+	cstore := NewCredentialStore()
 
 	// by provider
 	if len(creds.ProviderID) > 0 {
@@ -96,65 +341,206 @@ func (s *AccountStore) GetAccountKeyByCredentials(c context.Context, creds *Cred
 
 	// by username
 	var userNameCreds []*Credentials
-	_, err = cstore.GetByUsername(c, creds.Username, &userNameCreds)
+	keys, err := cstore.GetByUsername(c, creds.Username, &userNameCreds)
 	if err != nil {
 		return nil, err
 	}
 
 	if len(userNameCreds) != 1 {
-		return nil, errors.New("unable to find unique credentials")
+		return nil, errCredentialsNotFound
 	}
 
 	crypt := Crypt{}
-	err = crypt.Validate(userNameCreds[0].Password, creds.Password)
+	stored := userNameCreds[0]
+	err = crypt.Validate(stored.PasswordHash, creds.Password)
 	if err != nil {
 		return nil, err
 	}
-	return userNameCreds[0].Key.Parent(), nil
+
+	// upgrade hashes created with an older cost or algorithm; a failure here
+	// shouldn't prevent the user from signing in
+	if crypt.NeedsRehash(stored.PasswordHash) {
+		hash, err := crypt.Encrypt(creds.Password)
+		if err == nil {
+			stored.PasswordHash = hash
+			err = cstore.Update(c, keys[0], stored)
+		}
+		if err != nil {
+			log.Warningf(c, "failed to rehash password: %v", err)
+		}
+	}
+
+	return keys[0].Parent(), nil
 }
 
+// maxGetMulti is the most keys the datastore gets in a single call
+const maxGetMulti = 1000
+
+// eachBatchSize is how many accounts Each fetches with each query
+const eachBatchSize = 500
+
+// ErrStopIteration is returned from Each callbacks to stop without an error
+var ErrStopIteration = errors.New("stop iteration")
+
+// GetAllAccounts returns the page of accounts in key order
 func (s *AccountStore) GetAllAccounts(c context.Context, offset, limit int) ([]*Account, error) {
 	var accounts []*Account
-	doneChan := make(chan bool)
-	errChan := make(chan error)
-	dataChan := make(chan Account)
-
 	keys, err := datastore.NewQuery(s.TableName).
 		Limit(limit).
 		Offset(offset).
-		KeysOnly().
-		GetAll(c, nil)
+		GetAll(c, &accounts)
 	if err != nil {
 		return nil, err
 	}
-	for _, k := range keys {
-		go func(key *datastore.Key) {
-			var a Account
-			if err := s.Get(c, key, &a); err != nil {
-				if err != datastore.ErrNoSuchEntity {
-					errChan <- err
-				}
-				return
+
+	for i, key := range keys {
+		accounts[i].Key = key
+	}
+	return accounts, nil
+}
+
+// GetMulti returns the accounts in the same order as their keys, getting them
+// in batches; the accounts of keys that don't exist are nil
+func (s *AccountStore) GetMulti(c context.Context, keys []*datastore.Key) ([]*Account, error) {
+	accounts := make([]*Account, len(keys))
+	for start := 0; start < len(keys); start += maxGetMulti {
+		end := start + maxGetMulti
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		batch := make([]Account, end-start)
+		err := datastore.GetMulti(c, keys[start:end], batch)
+		errs, _ := err.(appengine.MultiError)
+		if err != nil && errs == nil {
+			return nil, err
+		}
+
+		for i := range batch {
+			if errs != nil && errs[i] == datastore.ErrNoSuchEntity {
+				continue
 			}
-			dataChan <- a
-		}(k)
+			if errs != nil && errs[i] != nil {
+				return nil, errs[i]
+			}
+			batch[i].Key = keys[start+i]
+			accounts[start+i] = &batch[i]
+		}
 	}
-	async.New().Run(doneChan, errChan)
+	return accounts, nil
+}
 
-LOOP:
-	for {
-		select {
-		case a := <-dataChan:
-			accounts = append(accounts, &a)
-		case <-doneChan:
-			break LOOP
-		case err = <-errChan:
-			break LOOP
-		case <-time.Tick(10 * time.Second):
-			err = errors.New("GetAllAccount timeout")
-			break LOOP
+// Backfill saves up to max accounts, starting at the cursor, that haven't been
+// saved since their Status and Created fields were added, so they are included
+// in filtered and ordered listings, and reserves their emails and usernames.
+// The usernames of every account are also normalized.
+// Their creation time isn't known, so Created is left zero and they are listed
+// as the oldest accounts. Returns the cursor to continue from, which is blank
+// once all accounts have been checked.
+func (s *AccountStore) Backfill(c context.Context, cursor string, max int) (string, error) {
+	var count int
+	cStore := NewCredentialStore()
+	return s.Each(c, cursor, func(account *Account) error {
+		if len(account.Status) == 0 {
+			err := s.backfill(c, account.Key)
+			if err != nil {
+				return err
+			}
+		}
+		err := cStore.NormalizeUsernames(c, account.Key)
+		if err != nil {
+			return fmt.Errorf("normalizing usernames: %v", err)
+		}
+
+		count++
+		if count >= max {
+			return ErrStopIteration
+		}
+		return nil
+	})
+}
+
+// backfill reserves the account's values, then saves it unless it has been
+// saved since it was fetched
+func (s *AccountStore) backfill(c context.Context, accountKey *datastore.Key) error {
+	rStore := NewReservationStore()
+	err := rStore.ReserveAll(c, accountKey)
+	if err != nil {
+		return fmt.Errorf("reserving values: %v", err)
+	}
+
+	return datastore.RunInTransaction(c, func(tc context.Context) error {
+		var account Account
+		err := datastore.Get(tc, accountKey, &account)
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		if err != nil || len(account.Status) > 0 {
+			return err
+		}
+		_, err = datastore.Put(tc, accountKey, &account)
+		return err
+	}, nil)
+}
+
+// Each calls fn with every account in key order, starting at the cursor, or
+// the first account if it is blank. Accounts are fetched in batches, each with
+// its own query, so long iterations don't hit the query deadline. Returns the
+// cursor to resume the iteration from, which is blank once all accounts have
+// been passed to fn. An error returned by fn stops the iteration and is
+// returned, unless it is ErrStopIteration, in which case the cursor follows the
+// account fn stopped at. After other errors the cursor is at the start of the
+// failed batch, so fn must handle being called again with the same accounts.
+func (s *AccountStore) Each(c context.Context, cursor string, fn func(account *Account) error) (string, error) {
+	var start datastore.Cursor
+	if len(cursor) > 0 {
+		var err error
+		start, err = datastore.DecodeCursor(cursor)
+		if err != nil {
+			return "", errInvalidCursor(err)
 		}
 	}
 
-	return accounts, err
+	for {
+		q := datastore.NewQuery(s.TableName).Limit(eachBatchSize)
+		if len(cursor) > 0 {
+			q = q.Start(start)
+		}
+
+		var count int
+		it := q.Run(c)
+		for {
+			var account Account
+			key, err := it.Next(&account)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				return cursor, err
+			}
+			count++
+
+			account.Key = key
+			err = fn(&account)
+			if err == ErrStopIteration {
+				next, err := it.Cursor()
+				if err != nil {
+					return cursor, err
+				}
+				return next.String(), nil
+			}
+			if err != nil {
+				return cursor, err
+			}
+		}
+		if count < eachBatchSize {
+			return "", nil
+		}
+
+		next, err := it.Cursor()
+		if err != nil {
+			return cursor, err
+		}
+		start, cursor = next, next.String()
+	}
 }
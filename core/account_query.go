@@ -0,0 +1,167 @@
+package core
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Account listing limits
+const (
+	DefaultAccountPageSize = 20
+	MaxAccountPageSize     = 100
+)
+
+// AccountOrders are the orders accounts can be listed in; `-` sorts descending
+var AccountOrders = []string{"created", "-created", "email", "-email"}
+
+// AccountQuery filters and orders the listed accounts. Accounts that haven't
+// been saved since the Created field was added lack it, so are only listed when
+// filtering by email.
+type AccountQuery struct {
+	Email         string
+	Status        string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// Order is one of the AccountOrders; defaults to "-created"
+	Order string
+	// Limit defaults to DefaultAccountPageSize
+	Limit int
+	// Cursor is the page token returned with the previous page
+	Cursor string
+}
+
+// AccountPage is a page of listed accounts
+type AccountPage struct {
+	Accounts []*Account
+	// Cursor continues the listing from the end of the page; blank for the last page
+	Cursor string
+}
+
+// List returns the page of accounts matching the query. Pages continue from
+// datastore cursors, so deep pages cost the same as the first.
+func (s *AccountStore) List(c context.Context, aq AccountQuery) (*AccountPage, error) {
+	q, err := s.query(c, aq)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := aq.Limit
+	if limit <= 0 {
+		limit = DefaultAccountPageSize
+	}
+	// one more than the limit is fetched to know if there is another page
+	q = q.Limit(limit + 1)
+	if len(aq.Cursor) > 0 {
+		cursor, err := datastore.DecodeCursor(aq.Cursor)
+		if err != nil {
+			return nil, errInvalidCursor(err)
+		}
+		q = q.Start(cursor)
+	}
+
+	page := AccountPage{Accounts: []*Account{}}
+	it := q.Run(c)
+	for {
+		var account Account
+		key, err := it.Next(&account)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			// cursors can't be used with a different query
+			if len(aq.Cursor) > 0 && len(page.Accounts) == 0 {
+				return nil, errInvalidCursor(err)
+			}
+			return nil, err
+		}
+
+		if len(page.Accounts) == limit {
+			cursor, err := it.Cursor()
+			if err != nil {
+				return nil, err
+			}
+			page.Cursor = cursor.String()
+			break
+		}
+
+		account.Key = key
+		page.Accounts = append(page.Accounts, &account)
+	}
+
+	return &page, nil
+}
+
+// Estimate counts the accounts matching the query, up to the max. Counting
+// reads every matching key, so the max bounds its cost.
+func (s *AccountStore) Estimate(c context.Context, aq AccountQuery, max int) (int, error) {
+	q, err := s.query(c, aq)
+	if err != nil {
+		return 0, err
+	}
+	return q.KeysOnly().Limit(max).Count(c)
+}
+
+// query builds the datastore query matching the account query. Filtering by a
+// created range requires ordering by created, and listings filtered by email
+// aren't ordered since emails are unique.
+func (s *AccountStore) query(c context.Context, aq AccountQuery) (*datastore.Query, error) {
+	v := validator{}
+	if len(aq.Status) > 0 {
+		v.oneOf("status", aq.Status, AccountStatuses)
+	}
+	if len(aq.Order) > 0 {
+		v.oneOf("sort", aq.Order, AccountOrders)
+	}
+	if aq.Limit > MaxAccountPageSize {
+		v.add("limit", "too_large", fmt.Sprintf("limit can't be more than %d", MaxAccountPageSize))
+	}
+	hasRange := !aq.CreatedAfter.IsZero() || !aq.CreatedBefore.IsZero()
+	if hasRange && (aq.Order == "email" || aq.Order == "-email") {
+		v.add("sort", "invalid_value", "accounts filtered by created can only be sorted by created")
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	q := datastore.NewQuery(s.TableName)
+	if len(aq.Email) > 0 {
+		q = q.Filter("Email =", NormalizeEmail(aq.Email))
+	}
+	if len(aq.Status) > 0 {
+		q = q.Filter("Status =", aq.Status)
+	}
+	if !aq.CreatedAfter.IsZero() {
+		q = q.Filter("Created >=", aq.CreatedAfter)
+	}
+	if !aq.CreatedBefore.IsZero() {
+		q = q.Filter("Created <", aq.CreatedBefore)
+	}
+
+	if len(aq.Email) > 0 && !hasRange {
+		return q, nil
+	}
+	switch aq.Order {
+	case "created":
+		q = q.Order("Created")
+	case "email":
+		q = q.Order("Email")
+	case "-email":
+		q = q.Order("-Email")
+	default:
+		q = q.Order("-Created")
+	}
+	return q, nil
+}
+
+// errInvalidCursor is returned for page tokens that aren't valid for the query
+func errInvalidCursor(err error) error {
+	return &Error{
+		Kind:    Invalid,
+		Code:    "invalid_page_token",
+		Message: "the page token is not valid for the query",
+		Err:     err,
+	}
+}
@@ -0,0 +1,67 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAccountStore_List(t *testing.T) {
+	c := getContext()
+	store := NewAccountStore()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		creds := Credentials{Username: fmt.Sprintf("lister%d", i), Password: "foobario"}
+		_, err := store.Create(c, &creds, &Account{Email: fmt.Sprintf("lister%d@example.com", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page, err := store.List(c, AccountQuery{Email: "lister1@Example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Accounts) != 1 || page.Accounts[0].Email != "lister1@example.com" {
+		t.Errorf("expected account matching email, got %v", page.Accounts)
+	}
+
+	// pages continue where the previous one ended
+	aq := AccountQuery{Status: AccountActive, CreatedAfter: start, Order: "created", Limit: 2}
+	first, err := store.List(c, aq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.Accounts) != 2 || len(first.Cursor) == 0 {
+		t.Fatalf("expected a full first page and page token, got %d accounts", len(first.Accounts))
+	}
+	aq.Cursor = first.Cursor
+	second, err := store.List(c, aq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(second.Accounts) != 1 || len(second.Cursor) > 0 {
+		t.Fatalf("expected the last page, got %d accounts", len(second.Accounts))
+	}
+	if second.Accounts[0].Key.Equal(first.Accounts[1].Key) {
+		t.Error("expected pages not to overlap")
+	}
+
+	count, err := store.Estimate(c, AccountQuery{CreatedAfter: start}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("expected 3 accounts, got %d", count)
+	}
+
+	_, err = store.List(c, AccountQuery{CreatedAfter: start, Order: "email"})
+	if KindOf(err) != Invalid {
+		t.Errorf("expected created range sorted by email to be invalid, got %v", err)
+	}
+	_, err = store.List(c, AccountQuery{Cursor: "not a cursor"})
+	if CodeOf(err) != "invalid_page_token" {
+		t.Errorf("expected invalid page token, got %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"google.golang.org/appengine/datastore"
+)
+
+func TestAccount_ApplyPatch(t *testing.T) {
+	account := Account{FirstName: "bob", Location: "Edmonton"}
+	err := account.ApplyPatch(map[string]json.RawMessage{
+		"firstName": json.RawMessage(`"jim"`),
+		"location":  json.RawMessage(`null`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.FirstName != "jim" || len(account.Location) > 0 {
+		t.Errorf("expected patch to be applied, got %+v", account)
+	}
+
+	err = account.ApplyPatch(map[string]json.RawMessage{
+		"emailVerified": json.RawMessage(`"2017-01-01T00:00:00Z"`),
+		"lastName":      json.RawMessage(`7`),
+	})
+	fields := FieldsOf(err)
+	if len(fields) != 2 || fields[0].Code != "not_editable" || fields[1].Code != "invalid_type" {
+		t.Errorf("expected invalid fields, got %v", fields)
+	}
+}
+
+func TestAccountStore_Patch(t *testing.T) {
+	c := getContext()
+	store := NewAccountStore()
+
+	key, err := store.Create(c, &Credentials{Username: "patcher", Password: "foobario"}, &Account{Email: "patcher@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, err := store.Patch(c, key, -1, map[string]json.RawMessage{"timezone": json.RawMessage(`"America/Edmonton"`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Timezone != "America/Edmonton" {
+		t.Errorf("expected timezone to be updated, got %s", account.Timezone)
+	}
+
+	// updates based on an older version are rejected
+	_, err = store.Patch(c, key, account.Version-1, map[string]json.RawMessage{"name": json.RawMessage(`"bob"`)})
+	if err != ErrStaleAccount {
+		t.Errorf("expected stale account, got %v", err)
+	}
+
+	_, err = store.Patch(c, key, account.Version, map[string]json.RawMessage{"locale": json.RawMessage(`"en_CA"`)})
+	if KindOf(err) != Invalid {
+		t.Errorf("expected invalid locale, got %v", err)
+	}
+
+	// the new email is reserved and the old one released
+	_, err = store.Patch(c, key, account.Version, map[string]json.RawMessage{"email": json.RawMessage(`"patched@example.com"`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Create(c, &Credentials{Username: "other patcher", Password: "foobario"}, &Account{Email: "patcher@example.com"})
+	if err != nil {
+		t.Errorf("expected old email to be released: %v", err)
+	}
+}
+
+func TestAccountStore_GetMulti(t *testing.T) {
+	c := getContext()
+	store := NewAccountStore()
+
+	var keys []*datastore.Key
+	for _, name := range []string{"multi1", "multi2"} {
+		key, err := store.Create(c, &Credentials{Username: name, Password: "foobario"}, &Account{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	missing := datastore.NewKey(c, accountsTable, "", 999999, nil)
+
+	// results follow the order of the keys
+	accounts, err := store.GetMulti(c, []*datastore.Key{keys[1], missing, keys[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 3 || accounts[0].Name != "multi2" || accounts[1] != nil || accounts[2].Name != "multi1" {
+		t.Errorf("expected accounts in key order, got %v", accounts)
+	}
+	if !accounts[0].Key.Equal(keys[1]) {
+		t.Errorf("expected account key to be set")
+	}
+}
+
+func TestAccountStore_Each(t *testing.T) {
+	c := getContext()
+	store := NewAccountStore()
+
+	for _, name := range []string{"each1", "each2"} {
+		_, err := store.Create(c, &Credentials{Username: name, Password: "foobario"}, &Account{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var count int
+	var first *datastore.Key
+	cursor, err := store.Each(c, "", func(account *Account) error {
+		if account.Key == nil {
+			t.Error("expected account key to be set")
+		}
+		first = account.Key
+		count++
+		return ErrStopIteration
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected iteration to stop after the first account, got %d", count)
+	}
+	if len(cursor) == 0 {
+		t.Fatal("expected a cursor to resume from")
+	}
+
+	// resumes after the account it stopped at
+	var resumed int
+	cursor, err = store.Each(c, cursor, func(account *Account) error {
+		if account.Key.Equal(first) {
+			t.Error("expected the iteration to resume after the stopped account")
+		}
+		resumed++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed == 0 || len(cursor) > 0 {
+		t.Errorf("expected the remaining accounts to be iterated, got %d with cursor %q", resumed, cursor)
+	}
+
+	failed := errors.New("failed")
+	_, err = store.Each(c, "", func(account *Account) error {
+		return failed
+	})
+	if err != failed {
+		t.Errorf("expected callback error to be returned, got %v", err)
+	}
+
+	if _, err = store.Each(c, "invalid", func(account *Account) error { return nil }); KindOf(err) != Invalid {
+		t.Errorf("expected invalid cursor, got %v", err)
+	}
+}
+
+func TestAccountStore_Backfill(t *testing.T) {
+	c := getContext()
+	store := NewAccountStore()
+
+	// saved before accounts had a status or creation time
+	legacy := struct{ Name string }{"legacy"}
+	legacyKey, err := datastore.Put(c, datastore.NewIncompleteKey(c, accountsTable, nil), &legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cursor string
+	for batches := 0; batches == 0 || len(cursor) > 0; batches++ {
+		if batches > 100 {
+			t.Fatal("expected the backfill to finish")
+		}
+		cursor, err = store.Backfill(c, cursor, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var account Account
+	err = datastore.Get(c, legacyKey, &account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Status != AccountActive || account.Name != "legacy" {
+		t.Errorf("expected the legacy account to be active, got %+v", account)
+	}
+}
+
+func TestAccountStore_CreateWeakPassword(t *testing.T) {
+	c := getContext()
+	store := NewAccountStore()
+
+	_, err := store.Create(c, &Credentials{Username: "weak", Password: "short"}, &Account{})
+	if err != ErrWeakPassword {
+		t.Errorf("expected weak password, got %v", err)
+	}
+}
+
+func TestAccountStore_CreateKeepsErrorKind(t *testing.T) {
+	c := getContext()
+	store := NewAccountStore()
+
+	_, err := store.Create(c, &Credentials{ProviderID: "1234"}, &Account{})
+	if err != ErrMissingCredentials {
+		t.Errorf("expected missing credentials, got %v", err)
+	}
+}
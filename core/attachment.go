@@ -6,13 +6,17 @@ import (
 	"fmt"
 	"io/ioutil"
 	"strings"
+	"time"
 
 	"github.com/chrisolsen/ae/image"
 	uuid "github.com/satori/go.uuid"
 	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/urlfetch"
 )
 
+const attachmentsTable = "attachments"
+
 // Attachment links data saved in an external storage
 type Attachment struct {
 	Name string `json:"name"`
@@ -29,6 +33,14 @@ func (ra *Attachment) Bytes() ([]byte, error) {
 	return []byte(data), err
 }
 
+// attachmentRecord records an attachment the server saved for an account, keyed
+// by the attachment's name. Account attachments can be set by clients, so only
+// recorded attachments are read or deleted on the account's behalf.
+type attachmentRecord struct {
+	Type    string    `datastore:",noindex"`
+	Created time.Time `datastore:",noindex"`
+}
+
 // AttachmentStore provides the methods to save to the external storage service
 type AttachmentStore struct{}
 
@@ -73,3 +85,32 @@ func (as AttachmentStore) CreateWithURL(c context.Context, url string) (*Attachm
 
 	return as.CreateWithData(c, data, resp.Header.Get("Content-Type"))
 }
+
+// Delete removes the attachment's data from the app's default bucket, where
+// image.NewWriter saves it. Attachments that no longer exist are ignored.
+func (as AttachmentStore) Delete(c context.Context, name string) error {
+	return GCSStorage{}.Delete(c, name)
+}
+
+// Record records that the attachment was saved for the account
+func (as AttachmentStore) Record(c context.Context, accountKey *datastore.Key, a *Attachment) error {
+	key := datastore.NewKey(c, attachmentsTable, a.Name, 0, accountKey)
+	_, err := datastore.Put(c, key, &attachmentRecord{Type: a.Type, Created: time.Now()})
+	return err
+}
+
+// Recorded returns the names of the attachments recorded for the account
+func (as AttachmentStore) Recorded(c context.Context, accountKey *datastore.Key) ([]string, error) {
+	keys, err := datastore.NewQuery(attachmentsTable).
+		Ancestor(accountKey).
+		KeysOnly().
+		GetAll(c, nil)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		names[i] = key.StringID()
+	}
+	return names, nil
+}
@@ -1,51 +1,254 @@
 package core
 
 import (
-	"errors"
-	"fmt"
-
-	"github.com/chrisolsen/fbgraphapi"
 	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
 )
 
+// ErrInvalidCredentials is returned when the credentials don't match an
+// account, regardless of whether a provider or username/password was used
+var ErrInvalidCredentials = NewError(Unauthorized, "invalid_credentials", "invalid credentials")
+
+// ErrUnknownProvider is returned when the credentials name an auth provider
+// that isn't supported
+var ErrUnknownProvider = NewError(Invalid, "unknown_provider", "unknown auth provider")
+
 type AuthService struct {
 	URLGetter URLGetter
+	Providers AuthProviders
+	// Device is the client that issued tokens are linked to
+	Device Device
+	// TwoFactor validates the second factor of accounts that have it enabled
+	TwoFactor TwoFactorService
+	// Throttle limits failed attempts per username and client IP; optional
+	Throttle *LoginThrottle
 }
 
 type AuthFunc func(c context.Context, creds *Credentials) (*Token, error)
 
+// VerifyFunc verifies provider credentials and returns the matching identity
+type VerifyFunc func(c context.Context, creds *Credentials) (*Identity, error)
+
 // Authenticate validates that the credentials match an account; if so creates
-// and links a new token to the account
+// and links a new token to the account. Credentials without a provider name are
+// treated as username / password credentials. Accounts with two-factor
+// authentication enabled receive a *SecondFactorRequired error instead, whose
+// challenge is exchanged for the token with CompleteTwoFactor. A *ThrottledError
+// is returned while the username or client have too many failed attempts.
 // POST /v1/auth
 //  {
 //  	"providerName": "facebook",
 //  	"providerId": "users-provider-id",
 //  	"providerToken": "provided-token"
 //  }
+//
+//  {
+//  	"username": "bob@example.com",
+//  	"password": "foobario"
+//  }
 func (s *AuthService) Authenticate(c context.Context, creds *Credentials) (*Token, error) {
-	var err error
 	tokenStore := NewTokenStore()
+
+	identityKey := UsernameThrottleKey(creds.Username)
+	if len(creds.ProviderName) > 0 {
+		identityKey = ProviderThrottleKey(creds.ProviderName, creds.ProviderID)
+	}
+	err := s.Throttle.Check(c, s.throttleKeys(identityKey)...)
+	if err != nil {
+		return nil, err
+	}
+
+	accountKey, err := s.authenticate(c, creds)
+	if err == ErrInvalidCredentials {
+		s.fail(c, s.throttleKeys(identityKey))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// client IP failures aren't reset, otherwise an attacker could clear them
+	// by signing in to their own account
+	err = s.Throttle.Reset(c, identityKey)
+	if err != nil {
+		log.Warningf(c, "resetting failed attempts: %v", err)
+	}
+
+	enabled, err := s.TwoFactor.Enabled(c, accountKey)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, s.challenge(c, accountKey)
+	}
+
+	token, err := tokenStore.Create(c, accountKey, s.Device)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// CompleteTwoFactor exchanges the challenge returned by Authenticate and a
+// TOTP or recovery code for a new token. The challenge is discarded after too
+// many invalid codes.
+func (s *AuthService) CompleteTwoFactor(c context.Context, challenge, code string) (*Token, error) {
+	tstore := NewOneTimeTokenStore()
+	key, err := tstore.key(c, challenge)
+	if err != nil {
+		return nil, ErrInvalidChallenge
+	}
+	accountKey := key.Parent()
+
+	throttleKeys := s.throttleKeys(AccountThrottleKey(accountKey))
+	err = s.Throttle.Check(c, throttleKeys...)
+	if err != nil {
+		return nil, err
+	}
+
+	// the challenge and second factor are children of the account, so the
+	// attempt can be recorded in a single transaction
+	var valid bool
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		valid = false
+		token, err := tstore.get(tc, key, PurposeTwoFactor)
+		if err == ErrInvalidToken {
+			return ErrInvalidChallenge
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = s.TwoFactor.validate(tc, accountKey, code)
+		if err == ErrInvalidTwoFactorCode {
+			token.Attempts++
+			if token.Attempts >= maxChallengeAttempts {
+				return datastore.Delete(tc, key)
+			}
+			_, err = datastore.Put(tc, key, token)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		valid = true
+		return datastore.Delete(tc, key)
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !valid {
+		s.fail(c, throttleKeys)
+		return nil, ErrInvalidTwoFactorCode
+	}
+
+	err = s.Throttle.Reset(c, AccountThrottleKey(accountKey))
+	if err != nil {
+		log.Warningf(c, "resetting failed attempts: %v", err)
+	}
+
+	tokenStore := NewTokenStore()
+	return tokenStore.Create(c, accountKey, s.Device)
+}
+
+// authenticate returns the key of the account matching the credentials
+func (s *AuthService) authenticate(c context.Context, creds *Credentials) (*datastore.Key, error) {
+	var err error
 	accountStore := NewAccountStore()
 
-	switch creds.ProviderName {
-	case "facebook":
-		err = fbgraphapi.Authenticate(creds.ProviderToken, creds.ProviderID, s.URLGetter)
-	default:
-		return nil, errors.New("unknown auth provider")
+	if len(creds.ProviderName) > 0 {
+		_, err = s.Verify(c, creds)
+	} else {
+		err = s.authenticateLocal(creds)
 	}
 	if err != nil {
-		return nil, fmt.Errorf("authenticate: %v", err)
+		return nil, err
 	}
 
+	// other failures, such as datastore errors, aren't the client's fault
 	accountKey, err := accountStore.GetAccountKeyByCredentials(c, creds)
+	if err == errProviderNotFound || err == errCredentialsNotFound || err == errPasswordMismatch {
+		return nil, ErrInvalidCredentials
+	}
 	if err != nil {
-		return nil, fmt.Errorf("getting account key by credentials: %v", err)
+		return nil, err
 	}
 
-	token, err := tokenStore.Create(c, accountKey)
+	// credentials can outlive purged accounts
+	var account Account
+	err = datastore.Get(c, accountKey, &account)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrInvalidCredentials
+	}
 	if err != nil {
 		return nil, err
 	}
+	if account.Status == AccountPendingDeletion || account.Status == accountPurging {
+		return nil, ErrAccountPendingDeletion
+	}
+	return accountKey, nil
+}
 
-	return token, nil
+// throttleKeys returns the key along with the client's IP key
+func (s *AuthService) throttleKeys(key string) []string {
+	keys := []string{key}
+	if len(s.Device.IP) > 0 {
+		keys = append(keys, IPThrottleKey(s.Device.IP))
+	}
+	return keys
+}
+
+// fail records the failed attempt; errors are only logged so the original
+// failure is returned
+func (s *AuthService) fail(c context.Context, keys []string) {
+	err := s.Throttle.Fail(c, keys...)
+	if err != nil {
+		log.Warningf(c, "recording failed attempt: %v", err)
+	}
+}
+
+// challenge creates the challenge that is exchanged for a token once the
+// second factor is validated
+func (s *AuthService) challenge(c context.Context, accountKey *datastore.Key) error {
+	tstore := NewOneTimeTokenStore()
+	token, err := tstore.Create(c, accountKey, PurposeTwoFactor, "", TwoFactorChallengeTTL)
+	if err != nil {
+		return err
+	}
+	return &SecondFactorRequired{Challenge: token.Value(), Expiry: token.Expiry}
+}
+
+// Verify validates the provider token with the registered provider matching
+// the credentials' provider name and returns the identity it belongs to
+func (s *AuthService) Verify(c context.Context, creds *Credentials) (*Identity, error) {
+	provider, ok := s.Providers.Get(creds.ProviderName)
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+
+	identity, err := provider.Verify(c, s.URLGetter, creds)
+	if err != nil && KindOf(err) == Upstream {
+		return nil, err
+	}
+	if err != nil {
+		log.Infof(c, "verifying %s token: %v", creds.ProviderName, err)
+		return nil, ErrInvalidCredentials
+	}
+
+	if identity.ProviderID != creds.ProviderID {
+		return nil, ErrInvalidCredentials
+	}
+
+	return identity, nil
+}
+
+// authenticateLocal ensures the username / password credentials are complete;
+// the password itself is validated against the stored hash on lookup
+func (s *AuthService) authenticateLocal(creds *Credentials) error {
+	if len(creds.Username) == 0 || len(creds.Password) == 0 {
+		return ErrInvalidCredentials
+	}
+	return nil
 }
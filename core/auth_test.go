@@ -1,6 +1,7 @@
 package core
 
 import (
+	"net/http"
 	"testing"
 
 	"google.golang.org/appengine/datastore"
@@ -26,15 +27,15 @@ func TestEndpoints_Auth(t *testing.T) {
 	// account to auth with
 	a := Account{}
 	pkey, _ := datastore.Put(c, datastore.NewIncompleteKey(c, "accounts", nil), &a)
-	creds := Credentials{ProviderID: "1234", ProviderName: "facebook", ProviderToken: "asoiudykaejhes"}
-	ckey, _ := datastore.Put(c, datastore.NewIncompleteKey(c, "credentials", pkey), &creds)
+	cstore := NewCredentialStore()
+	ckey, _ := cstore.Create(c, &Credentials{ProviderID: "1234", ProviderName: "facebook", ProviderToken: "asoiudykaejhes"}, pkey)
 
 	for _, ts := range tests {
 		ts.creds.Key = ckey
-		ts.creds.AccountKey = pkey // prevent the data propogation issue
 		func(test signupTest) {
 			authService := AuthService{
-				URLGetter: mockURLGetter{err: test.expectedErr, body: `{"id": "1234"}`},
+				URLGetter: facebookGetter("app-id", "1234", `{"id": "1234"}`),
+				Providers: AuthProviders{"facebook": FacebookProvider{AppID: "app-id", AppSecret: "secret"}},
 			}
 
 			token, err := authService.Authenticate(c, test.creds)
@@ -54,3 +55,112 @@ func TestEndpoints_Auth(t *testing.T) {
 		}(ts)
 	}
 }
+
+func TestEndpoints_AuthLocal(t *testing.T) {
+	c := getContext()
+
+	a := Account{}
+	pkey, _ := datastore.Put(c, datastore.NewIncompleteKey(c, "accounts", nil), &a)
+	cstore := NewCredentialStore()
+	_, err := cstore.Create(c, &Credentials{Username: "local@example.com", Password: "foobario"}, pkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mkey, _ := datastore.Put(c, datastore.NewIncompleteKey(c, "accounts", nil), &Account{})
+	_, err = cstore.Create(c, &Credentials{Username: "Mixed@Example.com", Password: "foobario"}, mkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type authTest struct {
+		name        string
+		creds       *Credentials
+		expectedErr error
+	}
+	tests := []authTest{
+		{name: "valid password", creds: &Credentials{Username: "local@example.com", Password: "foobario"}},
+		{name: "invalid password", creds: &Credentials{Username: "local@example.com", Password: "wrong"}, expectedErr: ErrInvalidCredentials},
+		{name: "username in another case", creds: &Credentials{Username: "Local@Example.com", Password: "foobario"}},
+		{name: "mixed case username", creds: &Credentials{Username: "mixed@example.com", Password: "foobario"}},
+		{name: "unknown username", creds: &Credentials{Username: "nobody@example.com", Password: "foobario"}, expectedErr: ErrInvalidCredentials},
+		{name: "account key without password check", creds: &Credentials{AccountKey: pkey, Username: "local@example.com", Password: "wrong"}, expectedErr: ErrInvalidCredentials},
+	}
+
+	authService := AuthService{}
+	for _, test := range tests {
+		token, err := authService.Authenticate(c, test.creds)
+		if err != test.expectedErr {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expectedErr, err)
+			continue
+		}
+		if err == nil && len(token.Value()) == 0 {
+			t.Errorf("%s: no token returned", test.name)
+		}
+	}
+}
+
+func TestEndpoints_AuthMissingAccount(t *testing.T) {
+	c := getContext()
+
+	// credentials left behind by a purged account
+	accountKey := datastore.NewKey(c, "accounts", "missing", 0, nil)
+	cstore := NewCredentialStore()
+	if _, err := cstore.Create(c, &Credentials{Username: "missing@example.com", Password: "foobario"}, accountKey); err != nil {
+		t.Fatal(err)
+	}
+
+	authService := AuthService{}
+	_, err := authService.Authenticate(c, &Credentials{Username: "missing@example.com", Password: "foobario"})
+	if err != ErrInvalidCredentials {
+		t.Errorf("expected invalid credentials, got %v", err)
+	}
+}
+
+func TestAuthProviders(t *testing.T) {
+	c := getContext()
+	providers := AuthProviders{}
+	providers.Register(FacebookProvider{AppID: "app-id", AppSecret: "secret"})
+
+	type providerTest struct {
+		name        string
+		creds       *Credentials
+		getter      URLGetter
+		expectedErr error
+	}
+	tests := []providerTest{
+		{
+			name:   "matching identity",
+			creds:  &Credentials{ProviderName: "facebook", ProviderID: "1234", ProviderToken: "abc"},
+			getter: facebookGetter("app-id", "1234", `{"id": "1234", "email": "bob@example.com"}`),
+		},
+		{
+			name:        "mismatched identity",
+			creds:       &Credentials{ProviderName: "facebook", ProviderID: "1234", ProviderToken: "abc"},
+			getter:      facebookGetter("app-id", "4321", `{"id": "4321"}`),
+			expectedErr: ErrInvalidCredentials,
+		},
+		{
+			name:        "rejected token",
+			creds:       &Credentials{ProviderName: "facebook", ProviderID: "1234", ProviderToken: "abc"},
+			getter:      mockURLGetter{body: `{"error": {}}`, status: http.StatusBadRequest},
+			expectedErr: ErrInvalidCredentials,
+		},
+		{
+			name:        "unregistered provider",
+			creds:       &Credentials{ProviderName: "twitter", ProviderID: "1234", ProviderToken: "abc"},
+			expectedErr: ErrUnknownProvider,
+		},
+	}
+
+	for _, test := range tests {
+		authService := AuthService{URLGetter: test.getter, Providers: providers}
+		identity, err := authService.Verify(c, test.creds)
+		if err != test.expectedErr {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expectedErr, err)
+			continue
+		}
+		if err == nil && identity.ProviderID != test.creds.ProviderID {
+			t.Errorf("%s: unexpected identity %v", test.name, identity.ProviderID)
+		}
+	}
+}
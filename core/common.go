@@ -2,6 +2,7 @@ package core
 
 import (
 	"net/http"
+	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/urlfetch"
@@ -19,3 +20,14 @@ func (ug AppEngineURLGetter) Get(url string) (*http.Response, error) {
 	client := urlfetch.Client(ug.Ctx)
 	return client.Get(url)
 }
+
+// Clock returns the current time; allows tests to control time dependent logic
+type Clock func() time.Time
+
+// Now returns the clock's time, falling back to the system time for nil clocks
+func (c Clock) Now() time.Time {
+	if c == nil {
+		return time.Now()
+	}
+	return c()
+}
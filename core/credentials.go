@@ -1,8 +1,8 @@
 package core
 
 import (
-	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/chrisolsen/ae/model"
 	"github.com/chrisolsen/ae/store"
@@ -11,12 +11,31 @@ import (
 	"google.golang.org/appengine/datastore"
 )
 
+const providerIdentitiesTable = "providerIdentities"
+
+// Credential errors
+var (
+	ErrCredentialsExist   = NewError(Conflict, "credentials_exist", "account credentials already exists")
+	ErrCredentialsInUse   = NewError(Conflict, "credentials_in_use", "credentials belong to another account")
+	ErrMissingCredentials = NewError(Invalid, "missing_credentials", "missing required credentials")
+	ErrLastCredentials    = NewError(Conflict, "last_credentials", "an account's last credentials can't be removed")
+
+	errProviderNotFound = NewError(NotFound, "provider_not_found", "no account found matching the auth provider")
+)
+
+// ProviderIdentity points a provider identity at the account it belongs to. It
+// is keyed by `providerName:providerID`, so lookups are strongly consistent gets
+// rather than queries.
+type ProviderIdentity struct {
+	AccountKey *datastore.Key `datastore:",noindex"`
+}
+
 // Credentials contain authentication details for various providers / methods
 type Credentials struct {
 	model.Base
 
-	// passed in on initial signup since looking up credentials by non-key cols
-	// may result in an empty dataset
+	// Deprecated: no longer needed since provider identities are looked up by
+	// key; still accepted from older clients but ignored
 	AccountKey *datastore.Key `json:"accountKey" datastore:"-"`
 
 	// oauth
@@ -25,10 +44,15 @@ type Credentials struct {
 
 	// token is not saved
 	ProviderToken string `json:"providerToken" datastore:"-"`
+	// nonce the provider token was issued with; required if the token has one
+	Nonce string `json:"nonce,omitempty" datastore:"-"`
 
 	// username / password
 	Username string `json:"username"`
-	Password string `json:"password"`
+	// raw password is only accepted as input and is never saved
+	Password string `json:"password,omitempty" datastore:"-"`
+	// bcrypt hash of the password; never returned to clients
+	PasswordHash string `json:"-" datastore:"Password,noindex"`
 }
 
 // Valid indicates if the credentials are valid for one of the two credential types
@@ -38,6 +62,24 @@ func (c *Credentials) Valid() bool {
 	return p || l
 }
 
+// Validate trims the username and checks the credentials' field lengths; the
+// password's strength is only checked when it is saved
+func (c *Credentials) Validate() error {
+	if !c.Valid() {
+		return ErrMissingCredentials
+	}
+	c.Username = strings.TrimSpace(c.Username)
+
+	v := validator{}
+	v.maxLength("providerName", c.ProviderName, maxProviderNameLength)
+	v.maxLength("providerId", c.ProviderID, maxProviderValueLength)
+	v.maxLength("providerToken", c.ProviderToken, maxProviderValueLength)
+	v.maxLength("nonce", c.Nonce, maxProviderValueLength)
+	v.maxLength("username", c.Username, MaxUsernameLength)
+	v.password("password", c.Password)
+	return v.err()
+}
+
 type CredentialStore struct {
 	store.Base
 }
@@ -48,34 +90,160 @@ func NewCredentialStore() CredentialStore {
 	return s
 }
 
+// Create saves the credentials for the account. Usernames are normalized and
+// reserved and provider identities are saved for lookups, so run within a
+// cross group transaction to save both atomically.
 func (s *CredentialStore) Create(c context.Context, creds *Credentials, accountKey *datastore.Key) (*datastore.Key, error) {
 	if !creds.Valid() {
-		return nil, errors.New("Invalid credentials")
+		return nil, ErrMissingCredentials
+	}
+	if len(creds.ProviderID) == 0 {
+		creds.Username = normalizeUsername(creds.Username)
 	}
 
-	q := datastore.NewQuery(s.TableName)
-	q.Ancestor(accountKey)
-	q.KeysOnly()
+	q := datastore.NewQuery(s.TableName).
+		Ancestor(accountKey).
+		KeysOnly()
 	if len(creds.ProviderID) > 0 {
-		q.Filter("ProviderID =", creds.ProviderID)
-		q.Filter("ProviderName =", creds.ProviderName)
+		q = q.Filter("ProviderID =", creds.ProviderID).
+			Filter("ProviderName =", creds.ProviderName)
 	} else {
-		q.Filter("Username =", creds.Username)
+		q = q.Filter("Username =", creds.Username)
 	}
 	keys, err := q.GetAll(c, nil)
 	if err != nil {
-		if err != datastore.ErrInvalidEntityType {
-			return nil, err
-		}
+		return nil, err
 	}
 	if len(keys) > 0 {
-		return nil, errors.New("account credentials already exists")
+		return nil, ErrCredentialsExist
+	}
+
+	// usernames and provider identities are unique across all accounts
+	if len(creds.ProviderID) > 0 {
+		err = s.claimProvider(c, accountKey, creds)
+	} else {
+		rStore := NewReservationStore()
+		err = rStore.Reserve(c, accountKey, ReserveUsername, creds.Username)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(creds.Password) > 0 {
+		crypt := Crypt{}
+		creds.PasswordHash, err = crypt.Encrypt(creds.Password)
+		if err != nil {
+			return nil, fmt.Errorf("hashing password: %v", err)
+		}
+		creds.Password = ""
 	}
 
 	return s.Base.Create(c, creds, accountKey)
 }
 
+// Link adds another login method to an existing account. Provider credentials
+// must be verified beforehand. Accounts can only have one username / password,
+// and credentials that belong to another account are rejected.
+func (s *CredentialStore) Link(c context.Context, accountKey *datastore.Key, creds *Credentials) (*datastore.Key, error) {
+	if len(creds.ProviderID) == 0 && len(creds.Password) < MinPasswordLength {
+		return nil, ErrWeakPassword
+	}
+
+	if len(creds.ProviderID) > 0 {
+		ownerKey, err := s.GetAccountKeyByProvider(c, creds)
+		if err == nil {
+			if ownerKey.Equal(accountKey) {
+				return nil, ErrCredentialsExist
+			}
+			return nil, ErrCredentialsInUse
+		}
+		if err != errProviderNotFound {
+			return nil, err
+		}
+	}
+
+	var key *datastore.Key
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		if len(creds.ProviderID) == 0 {
+			var accountCreds []*Credentials
+			_, err := s.GetByParent(tc, accountKey, &accountCreds)
+			if err != nil {
+				return err
+			}
+			for _, ac := range accountCreds {
+				if len(ac.Username) > 0 {
+					return ErrCredentialsExist
+				}
+			}
+		}
+
+		var err error
+		key, err = s.Create(tc, creds, accountKey)
+		if err == ErrUsernameTaken {
+			return ErrCredentialsInUse
+		}
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Unlink removes the login method from the account, unless it is the account's
+// last one
+func (s *CredentialStore) Unlink(c context.Context, accountKey, credsKey *datastore.Key) error {
+	if !credsKey.Parent().Equal(accountKey) {
+		return datastore.ErrNoSuchEntity
+	}
+
+	rStore := NewReservationStore()
+	return datastore.RunInTransaction(c, func(tc context.Context) error {
+		var accountCreds []*Credentials
+		keys, err := s.GetByParent(tc, accountKey, &accountCreds)
+		if err != nil {
+			return err
+		}
+
+		var creds *Credentials
+		for i, key := range keys {
+			if key.Equal(credsKey) {
+				creds = accountCreds[i]
+			}
+		}
+		if creds == nil {
+			return datastore.ErrNoSuchEntity
+		}
+		if len(keys) == 1 {
+			return ErrLastCredentials
+		}
+
+		if len(creds.ProviderID) > 0 {
+			err = datastore.Delete(tc, s.providerKey(tc, creds.ProviderName, creds.ProviderID))
+		} else if len(creds.Username) > 0 {
+			err = rStore.Release(tc, accountKey, ReserveUsername, creds.Username)
+		}
+		if err != nil {
+			return err
+		}
+		return datastore.Delete(tc, credsKey)
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+// GetAccountKeyByProvider returns the key of the account the provider identity
+// belongs to
 func (s *CredentialStore) GetAccountKeyByProvider(c context.Context, creds *Credentials) (*datastore.Key, error) {
+	key := s.providerKey(c, creds.ProviderName, creds.ProviderID)
+	var identity ProviderIdentity
+	err := datastore.Get(c, key, &identity)
+	if err == nil {
+		return identity.AccountKey, nil
+	}
+	if err != datastore.ErrNoSuchEntity {
+		return nil, fmt.Errorf("finding account by auth provider: %v", err)
+	}
+
+	// credentials saved before the lookups existed can only be found by query
 	keys, err := datastore.NewQuery(s.TableName).
 		Filter("ProviderID =", creds.ProviderID).
 		Filter("ProviderName =", creds.ProviderName).
@@ -87,13 +255,114 @@ func (s *CredentialStore) GetAccountKeyByProvider(c context.Context, creds *Cred
 	}
 
 	if len(keys) == 0 {
-		return nil, errors.New("no account found matching the auth provider")
+		return nil, errProviderNotFound
 	}
 
-	return keys[0].Parent(), nil
+	accountKey, err := s.backfillProvider(c, keys[0], creds)
+	if err != nil && err != errProviderNotFound {
+		return nil, fmt.Errorf("saving provider identity lookup: %v", err)
+	}
+	return accountKey, err
 }
 
-// GetByUsername .
+// backfillProvider saves the lookup of the provider identity found by query.
+// The query may be stale, so the credentials are read again to make sure they
+// haven't been unlinked or deleted since.
+func (s *CredentialStore) backfillProvider(c context.Context, credsKey *datastore.Key, creds *Credentials) (*datastore.Key, error) {
+	key := s.providerKey(c, creds.ProviderName, creds.ProviderID)
+	var accountKey *datastore.Key
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		var stored Credentials
+		err := datastore.Get(tc, credsKey, &stored)
+		if err == datastore.ErrNoSuchEntity {
+			return errProviderNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if stored.ProviderID != creds.ProviderID || stored.ProviderName != creds.ProviderName {
+			return errProviderNotFound
+		}
+
+		// saved by another request since it was read
+		var identity ProviderIdentity
+		err = datastore.Get(tc, key, &identity)
+		if err == nil {
+			accountKey = identity.AccountKey
+			return nil
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		accountKey = credsKey.Parent()
+		_, err = datastore.Put(tc, key, &ProviderIdentity{AccountKey: accountKey})
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return nil, err
+	}
+	return accountKey, nil
+}
+
+// claimProvider saves the provider identity's lookup, unless it belongs to
+// another account
+func (s *CredentialStore) claimProvider(c context.Context, accountKey *datastore.Key, creds *Credentials) error {
+	key := s.providerKey(c, creds.ProviderName, creds.ProviderID)
+	var identity ProviderIdentity
+	err := datastore.Get(c, key, &identity)
+	if err == nil && !identity.AccountKey.Equal(accountKey) {
+		return ErrCredentialsInUse
+	}
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+
+	_, err = datastore.Put(c, key, &ProviderIdentity{AccountKey: accountKey})
+	return err
+}
+
+func (s *CredentialStore) providerKey(c context.Context, providerName, providerID string) *datastore.Key {
+	return datastore.NewKey(c, providerIdentitiesTable, providerName+":"+providerID, 0, nil)
+}
+
+// GetByUsername returns the credentials with the username, regardless of its
+// case. Usernames saved before they were normalized only match exactly until
+// they are backfilled.
 func (s *CredentialStore) GetByUsername(c context.Context, username string, dst interface{}) ([]*datastore.Key, error) {
-	return datastore.NewQuery(s.TableName).Filter("Username =", username).GetAll(c, dst)
+	normalized := normalizeUsername(username)
+	keys, err := datastore.NewQuery(s.TableName).Filter("Username =", normalized).GetAll(c, dst)
+	if err != nil || len(keys) > 0 || normalized == strings.TrimSpace(username) {
+		return keys, err
+	}
+	return datastore.NewQuery(s.TableName).Filter("Username =", strings.TrimSpace(username)).GetAll(c, dst)
+}
+
+// NormalizeUsernames normalizes the usernames of the account's credentials
+// that were saved before usernames were normalized
+func (s *CredentialStore) NormalizeUsernames(c context.Context, accountKey *datastore.Key) error {
+	return datastore.RunInTransaction(c, func(tc context.Context) error {
+		var creds []*Credentials
+		keys, err := s.GetByParent(tc, accountKey, &creds)
+		if err != nil {
+			return err
+		}
+		for i, cr := range creds {
+			if len(cr.ProviderID) > 0 || cr.Username == normalizeUsername(cr.Username) {
+				continue
+			}
+			cr.Username = normalizeUsername(cr.Username)
+			_, err = datastore.Put(tc, keys[i], cr)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil)
+}
+
+// normalizeUsername trims and lower cases the username, the same way its
+// reservation is, so usernames match regardless of case
+func normalizeUsername(username string) string {
+	return normalizeReserved(username)
 }
@@ -66,6 +66,179 @@ func TestCredentials_Create(t *testing.T) {
 	}
 }
 
+func TestCredentials_CreateHashesPassword(t *testing.T) {
+	ctx := getContext()
+	store := NewCredentialStore()
+	accountKey := datastore.NewKey(ctx, "accounts", "hashed", 0, nil)
+
+	creds := Credentials{Username: "sally", Password: "foobar"}
+	key, err := store.Create(ctx, &creds, accountKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var saved Credentials
+	if err = datastore.Get(ctx, key, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.PasswordHash == "" || saved.PasswordHash == "foobar" {
+		t.Errorf("password was saved unhashed: %q", saved.PasswordHash)
+	}
+
+	crypt := Crypt{}
+	if err = crypt.Validate(saved.PasswordHash, "foobar"); err != nil {
+		t.Errorf("saved hash doesn't match password: %v", err)
+	}
+}
+
 func TestCredentials_GetAccountKeyByProvider(t *testing.T) {
+	ctx := getContext()
+	store := NewCredentialStore()
+	accountKey := datastore.NewKey(ctx, "accounts", "provider-lookup", 0, nil)
+
+	creds := Credentials{ProviderID: "lookup-1", ProviderName: "google", ProviderToken: "x"}
+	if _, err := store.Create(ctx, &creds, accountKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// found right away, without waiting on the query index
+	key, err := store.GetAccountKeyByProvider(ctx, &creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equal(accountKey) {
+		t.Errorf("expected %v, got %v", accountKey, key)
+	}
+
+	// provider ids are only unique per provider
+	if _, err = store.GetAccountKeyByProvider(ctx, &Credentials{ProviderID: "lookup-1", ProviderName: "facebook"}); err == nil {
+		t.Error("expected no account for another provider")
+	}
+
+	otherKey := datastore.NewKey(ctx, "accounts", "other-provider-lookup", 0, nil)
+	if _, err = store.Create(ctx, &Credentials{ProviderID: "lookup-1", ProviderName: "google", ProviderToken: "x"}, otherKey); err != ErrCredentialsInUse {
+		t.Errorf("expected identity to be in use, got %v", err)
+	}
+}
+
+func TestCredentialStore_BackfillProvider(t *testing.T) {
+	ctx := getContext()
+	store := NewCredentialStore()
+	accountKey := datastore.NewKey(ctx, "accounts", "backfill", 0, nil)
+
+	// legacy credentials saved before the lookups existed
+	creds := Credentials{ProviderID: "backfill-1", ProviderName: "google"}
+	credsKey, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "credentials", accountKey), &creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := store.backfillProvider(ctx, credsKey, &creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equal(accountKey) {
+		t.Errorf("expected %v, got %v", accountKey, key)
+	}
+
+	// stale query results must not restore lookups of deleted credentials
+	unlinked := Credentials{ProviderID: "backfill-2", ProviderName: "google"}
+	unlinkedKey, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "credentials", accountKey), &unlinked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = datastore.Delete(ctx, unlinkedKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.backfillProvider(ctx, unlinkedKey, &unlinked); err != errProviderNotFound {
+		t.Errorf("expected provider not found, got %v", err)
+	}
+	var identity ProviderIdentity
+	if err = datastore.Get(ctx, store.providerKey(ctx, "google", "backfill-2"), &identity); err != datastore.ErrNoSuchEntity {
+		t.Errorf("expected no lookup to be saved, got %v", err)
+	}
+}
 
+func TestCredentialStore_Link(t *testing.T) {
+	ctx := getContext()
+	store := NewCredentialStore()
+	accountKey := datastore.NewKey(ctx, "accounts", "linker", 0, nil)
+	otherKey := datastore.NewKey(ctx, "accounts", "other-linker", 0, nil)
+
+	if _, err := store.Create(ctx, &Credentials{ProviderID: "link-1", ProviderName: "google", ProviderToken: "x"}, otherKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Create(ctx, &Credentials{ProviderID: "link-2", ProviderName: "google", ProviderToken: "x"}, accountKey); err != nil {
+		t.Fatal(err)
+	}
+
+	type data struct {
+		name  string
+		creds *Credentials
+		err   error
+	}
+	tests := []data{
+		data{name: "other account's provider", creds: &Credentials{ProviderID: "link-1", ProviderName: "google", ProviderToken: "x"}, err: ErrCredentialsInUse},
+		data{name: "already linked provider", creds: &Credentials{ProviderID: "link-2", ProviderName: "google", ProviderToken: "x"}, err: ErrCredentialsExist},
+		data{name: "weak password", creds: &Credentials{Username: "linker", Password: "short"}, err: ErrWeakPassword},
+		data{name: "new provider", creds: &Credentials{ProviderID: "link-3", ProviderName: "facebook", ProviderToken: "x"}, err: nil},
+		data{name: "username", creds: &Credentials{Username: "linker", Password: "foobario"}, err: nil},
+		data{name: "second username", creds: &Credentials{Username: "linker-2", Password: "foobario"}, err: ErrCredentialsExist},
+	}
+	for _, test := range tests {
+		if _, err := store.Link(ctx, accountKey, test.creds); err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestCredentialStore_Unlink(t *testing.T) {
+	ctx := getContext()
+	store := NewCredentialStore()
+	accountKey := datastore.NewKey(ctx, "accounts", "unlinker", 0, nil)
+	otherKey := datastore.NewKey(ctx, "accounts", "other-unlinker", 0, nil)
+
+	key1, err := store.Create(ctx, &Credentials{ProviderID: "unlink-1", ProviderName: "google", ProviderToken: "x"}, accountKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, err := store.Create(ctx, &Credentials{Username: "unlinker", Password: "foobario"}, accountKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = store.Unlink(ctx, otherKey, key1); err != datastore.ErrNoSuchEntity {
+		t.Errorf("expected other account's credentials to not be found, got %v", err)
+	}
+	if err = store.Unlink(ctx, accountKey, key1); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Unlink(ctx, accountKey, key2); err != ErrLastCredentials {
+		t.Errorf("expected last credentials to be kept, got %v", err)
+	}
+}
+
+func TestCredentialStore_NormalizeUsernames(t *testing.T) {
+	c := getContext()
+	store := NewCredentialStore()
+
+	// saved before usernames were normalized
+	accountKey, _ := datastore.Put(c, datastore.NewIncompleteKey(c, "accounts", nil), &Account{})
+	_, err := datastore.Put(c, datastore.NewIncompleteKey(c, "credentials", accountKey), &Credentials{Username: "Legacy@Example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var creds []*Credentials
+	if keys, err := store.GetByUsername(c, "Legacy@Example.com", &creds); err != nil || len(keys) != 1 {
+		t.Errorf("expected legacy username to match exactly, got %d: %v", len(keys), err)
+	}
+
+	if err = store.NormalizeUsernames(c, accountKey); err != nil {
+		t.Fatal(err)
+	}
+	creds = nil
+	keys, err := store.GetByUsername(c, "LEGACY@example.com", &creds)
+	if err != nil || len(keys) != 1 || creds[0].Username != "legacy@example.com" {
+		t.Errorf("expected normalized username to match in any case, got %d: %v", len(keys), err)
+	}
 }
@@ -1,19 +1,70 @@
 package core
 
 import (
+	"crypto/subtle"
+	"errors"
+
 	"golang.org/x/crypto/bcrypt"
 )
 
+// PasswordCost is the bcrypt cost used when a Crypt doesn't specify its own.
+// Raising it causes existing hashes to be upgraded on the next successful login.
+// Costs outside of bcrypt.MinCost and bcrypt.MaxCost are clamped to the range.
+var PasswordCost = bcrypt.DefaultCost
+
+var errPasswordMismatch = errors.New("password does not match")
+
 // Crypt .
-type Crypt struct{}
+type Crypt struct {
+	// Cost overrides the package PasswordCost when set
+	Cost int
+}
+
+// cost returns the configured cost, clamped to the range bcrypt accepts
+func (c *Crypt) cost() int {
+	cost := PasswordCost
+	if c.Cost > 0 {
+		cost = c.Cost
+	}
+	if cost < bcrypt.MinCost {
+		return bcrypt.MinCost
+	}
+	if cost > bcrypt.MaxCost {
+		return bcrypt.MaxCost
+	}
+	return cost
+}
 
 // Encrypt converts the raw password to a brcypt hash
 func (c *Crypt) Encrypt(password string) (string, error) {
-	b, err := bcrypt.GenerateFromPassword([]byte(password), 10)
+	b, err := bcrypt.GenerateFromPassword([]byte(password), c.cost())
 	return string(b), err
 }
 
-// Validate checks that the saved hash and raw password hash match
+// Validate checks that the saved hash and raw password hash match, returning
+// errPasswordMismatch if they don't. Values that were saved before passwords
+// were hashed are compared as plain text so they can be upgraded via
+// NeedsRehash.
 func (c *Crypt) Validate(hash, password string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		if len(hash) > 0 && subtle.ConstantTimeCompare([]byte(hash), []byte(password)) == 1 {
+			return nil
+		}
+		return errPasswordMismatch
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return errPasswordMismatch
+	}
+	return err
+}
+
+// NeedsRehash indicates if the hash was created with a different algorithm or
+// cost than is currently configured
+func (c *Crypt) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return true
+	}
+	return cost != c.cost()
 }
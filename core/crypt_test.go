@@ -0,0 +1,82 @@
+package core
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCrypt_Validate(t *testing.T) {
+	crypt := Crypt{Cost: 4}
+	hash, err := crypt.Encrypt("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash == "foobar" {
+		t.Error("password was not hashed")
+	}
+
+	type data struct {
+		name     string
+		hash     string
+		password string
+		ok       bool
+	}
+	tests := []data{
+		data{name: "matching hash", hash: hash, password: "foobar", ok: true},
+		data{name: "mismatched hash", hash: hash, password: "foobaz", ok: false},
+		data{name: "legacy plain text", hash: "foobar", password: "foobar", ok: true},
+		data{name: "mismatched legacy plain text", hash: "foobar", password: "foobaz", ok: false},
+		data{name: "empty hash", hash: "", password: "", ok: false},
+	}
+
+	for _, test := range tests {
+		err := crypt.Validate(test.hash, test.password)
+		if test.ok && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.ok && err != errPasswordMismatch {
+			t.Errorf("%s: expected password mismatch, got %v", test.name, err)
+		}
+	}
+}
+
+func TestCrypt_NeedsRehash(t *testing.T) {
+	old := Crypt{Cost: 4}
+	hash, err := old.Encrypt("foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if old.NeedsRehash(hash) {
+		t.Error("hash with current cost should not need rehash")
+	}
+
+	current := Crypt{Cost: 5}
+	if !current.NeedsRehash(hash) {
+		t.Error("hash with older cost should need rehash")
+	}
+	if !current.NeedsRehash("foobar") {
+		t.Error("plain text value should need rehash")
+	}
+}
+
+func TestCrypt_Cost(t *testing.T) {
+	type data struct {
+		name     string
+		cost     int
+		expected int
+	}
+	tests := []data{
+		data{name: "configured", cost: 12, expected: 12},
+		data{name: "too low", cost: 1, expected: bcrypt.MinCost},
+		data{name: "too high", cost: 99, expected: bcrypt.MaxCost},
+	}
+
+	for _, test := range tests {
+		crypt := Crypt{Cost: test.cost}
+		if cost := crypt.cost(); cost != test.expected {
+			t.Errorf("%s: expected cost %d, got %d", test.name, test.expected, cost)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package core
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+// DefaultDeletionGracePeriod is how long deleted accounts can be restored when
+// the service doesn't specify
+const DefaultDeletionGracePeriod = time.Hour * 24 * 30
+
+// the most keys deleted in a single call
+const maxDeleteMulti = 500
+
+// Deletion errors
+var (
+	ErrAccountPendingDeletion = NewError(Forbidden, "account_pending_deletion", "the account is scheduled to be deleted")
+	ErrNotPendingDeletion     = NewError(Conflict, "not_pending_deletion", "the account isn't scheduled to be deleted")
+)
+
+// AttachmentDeleter removes attachments from the external storage
+type AttachmentDeleter interface {
+	Delete(c context.Context, name string) error
+}
+
+// DeletionService soft deletes accounts and purges them, along with everything
+// that belongs to them, once their grace period ends
+type DeletionService struct {
+	Mailer Mailer
+	// RestoreURL is the link sent to users; `{code}` is replaced with the code
+	// that cancels the deletion
+	RestoreURL  string
+	GracePeriod time.Duration
+	// Storage deletes the account's recorded attachments and export
+	Storage AttachmentDeleter
+	Clock   Clock
+}
+
+// DeletedAccountCacheKey is the memcache key flagging the account as deleted,
+// so stateless access tokens can be refused until they expire
+func DeletedAccountCacheKey(accountKey *datastore.Key) string {
+	return "deletedAccount:" + accountKey.Encode()
+}
+
+// Schedule soft deletes the account and signs out all of its tokens. The
+// account is purged once the grace period ends, unless the deletion is
+// cancelled. Returns when the account will be purged.
+func (s *DeletionService) Schedule(c context.Context, accountKey *datastore.Key) (time.Time, error) {
+	var account Account
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		account = Account{}
+		err := datastore.Get(tc, accountKey, &account)
+		if err != nil {
+			return err
+		}
+		if account.Status == AccountPendingDeletion || account.Status == accountPurging {
+			return nil
+		}
+
+		account.Status = AccountPendingDeletion
+		account.DeleteAfter = s.Clock.Now().Add(s.gracePeriod())
+		_, err = datastore.Put(tc, accountKey, &account)
+		return err
+	}, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	tstore := NewTokenStore()
+	err = tstore.RevokeAll(c, accountKey)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("revoking tokens: %v", err)
+	}
+
+	err = memcache.Set(c, &memcache.Item{
+		Key:        DeletedAccountCacheKey(accountKey),
+		Value:      []byte(account.DeleteAfter.Format(time.RFC3339)),
+		Expiration: account.DeleteAfter.Sub(s.Clock.Now()),
+	})
+	if err != nil {
+		log.Warningf(c, "caching deleted account: %v", err)
+	}
+
+	return account.DeleteAfter, nil
+}
+
+// SendRestoreCode emails the account a code that cancels its deletion; the
+// code expires when the account is purged
+func (s *DeletionService) SendRestoreCode(c context.Context, accountKey *datastore.Key) error {
+	var account Account
+	err := datastore.Get(c, accountKey, &account)
+	if err != nil {
+		return err
+	}
+	if account.Status != AccountPendingDeletion {
+		return ErrNotPendingDeletion
+	}
+	if len(account.Email) == 0 {
+		return nil
+	}
+
+	tstore := NewOneTimeTokenStore()
+	err = tstore.DeleteAll(c, accountKey, PurposeRestoreAccount)
+	if err != nil {
+		return err
+	}
+	token, err := tstore.Create(c, accountKey, PurposeRestoreAccount, "", account.DeleteAfter.Sub(s.Clock.Now()))
+	if err != nil {
+		return fmt.Errorf("creating restore code: %v", err)
+	}
+
+	link := strings.Replace(s.RestoreURL, "{code}", url.QueryEscape(token.Value()), -1)
+	return s.Mailer.Send(c, &Message{
+		To:      account.Email,
+		Subject: "Your account will be deleted",
+		Body: fmt.Sprintf("Your account will be deleted on %s. Use the following link to keep it.\n\n%s\n",
+			account.DeleteAfter.Format("January 2, 2006"), link),
+	})
+}
+
+// Cancel restores the account the emailed restore code belongs to. Each code
+// can only be used once.
+func (s *DeletionService) Cancel(c context.Context, code string) error {
+	tstore := NewOneTimeTokenStore()
+	key, err := tstore.key(c, code)
+	if err != nil {
+		return err
+	}
+	accountKey := key.Parent()
+
+	// the code and account are in the same entity group
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		_, err := tstore.get(tc, key, PurposeRestoreAccount)
+		if err != nil {
+			return err
+		}
+		err = datastore.Delete(tc, key)
+		if err != nil {
+			return err
+		}
+		return s.restore(tc, accountKey)
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	return s.uncache(c, accountKey)
+}
+
+// Restore cancels the account's deletion without a restore code, for admins
+func (s *DeletionService) Restore(c context.Context, accountKey *datastore.Key) error {
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		return s.restore(tc, accountKey)
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	tstore := NewOneTimeTokenStore()
+	err = tstore.DeleteAll(c, accountKey, PurposeRestoreAccount)
+	if err != nil {
+		return err
+	}
+	return s.uncache(c, accountKey)
+}
+
+// Purge hard deletes the accounts whose grace period has ended, including
+// accounts whose previous purge failed part way. Each account is purged
+// separately, so a failure doesn't stop the others; the first error is
+// returned. Returns the number of accounts purged.
+func (s *DeletionService) Purge(c context.Context) (int, error) {
+	due, err := datastore.NewQuery(accountsTable).
+		Filter("Status =", AccountPendingDeletion).
+		Filter("DeleteAfter <=", s.Clock.Now()).
+		KeysOnly().
+		GetAll(c, nil)
+	if err != nil {
+		return 0, err
+	}
+	failed, err := datastore.NewQuery(accountsTable).
+		Filter("Status =", accountPurging).
+		KeysOnly().
+		GetAll(c, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	var firstErr error
+	for _, key := range append(due, failed...) {
+		err = s.purge(c, key)
+		if err != nil {
+			log.Errorf(c, "purging account %s: %v", key.Encode(), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		count++
+	}
+	return count, firstErr
+}
+
+// purge deletes the account along with its attachments, export, children,
+// reservations and provider identities. The account is flagged as purging
+// first, so it can no longer be restored, and is deleted last, so failed purges
+// are retried.
+func (s *DeletionService) purge(c context.Context, accountKey *datastore.Key) error {
+	var account Account
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		account = Account{}
+		err := datastore.Get(tc, accountKey, &account)
+		if err != nil {
+			return err
+		}
+		if account.Status == accountPurging {
+			return nil
+		}
+		if account.Status != AccountPendingDeletion || account.DeleteAfter.After(s.Clock.Now()) {
+			return ErrNotPendingDeletion
+		}
+		account.Status = accountPurging
+		_, err = datastore.Put(tc, accountKey, &account)
+		return err
+	}, nil)
+	// restored or already purged since it was queried
+	if err == ErrNotPendingDeletion || err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// account attachments can be set by clients, so only the recorded ones
+	// are deleted
+	if s.Storage != nil {
+		names, err := AttachmentStore{}.Recorded(c, accountKey)
+		if err != nil {
+			return fmt.Errorf("getting attachments: %v", err)
+		}
+		for _, name := range names {
+			err = s.Storage.Delete(c, name)
+			if err != nil {
+				return fmt.Errorf("deleting attachment %s: %v", name, err)
+			}
+		}
+		err = s.Storage.Delete(c, ExportName(accountKey))
+		if err != nil {
+			return fmt.Errorf("deleting export: %v", err)
+		}
+	}
+
+	// tokens are revoked to also remove their cached details
+	tstore := NewTokenStore()
+	err = tstore.RevokeAll(c, accountKey)
+	if err != nil {
+		return fmt.Errorf("revoking tokens: %v", err)
+	}
+
+	// each provider identity is deleted along with its credentials, so sign ins
+	// can't recreate the identity from the credentials in between
+	cstore := NewCredentialStore()
+	var creds []*Credentials
+	credsKeys, err := cstore.GetByParent(c, accountKey, &creds)
+	if err != nil {
+		return fmt.Errorf("getting credentials: %v", err)
+	}
+	for i, cr := range creds {
+		if len(cr.ProviderID) == 0 {
+			continue
+		}
+		keys := []*datastore.Key{cstore.providerKey(c, cr.ProviderName, cr.ProviderID), credsKeys[i]}
+		err = datastore.RunInTransaction(c, func(tc context.Context) error {
+			return datastore.DeleteMulti(tc, keys)
+		}, &datastore.TransactionOptions{XG: true})
+		if err != nil {
+			return fmt.Errorf("deleting provider identity: %v", err)
+		}
+	}
+
+	rstore := NewReservationStore()
+	err = rstore.ReleaseAll(c, accountKey)
+	if err != nil {
+		return fmt.Errorf("releasing reservations: %v", err)
+	}
+
+	// credentials, one time tokens, second factors and any other children
+	keys, err := datastore.NewQuery("").
+		Ancestor(accountKey).
+		KeysOnly().
+		GetAll(c, nil)
+	if err != nil {
+		return fmt.Errorf("getting children: %v", err)
+	}
+	var children []*datastore.Key
+	for _, key := range keys {
+		if !key.Equal(accountKey) {
+			children = append(children, key)
+		}
+	}
+	err = deleteMulti(c, children)
+	if err != nil {
+		return fmt.Errorf("deleting children: %v", err)
+	}
+
+	err = datastore.Delete(c, accountKey)
+	if err != nil {
+		return err
+	}
+	return s.uncache(c, accountKey)
+}
+
+// restore clears the account's pending deletion; must be run in a transaction
+func (s *DeletionService) restore(c context.Context, accountKey *datastore.Key) error {
+	var account Account
+	err := datastore.Get(c, accountKey, &account)
+	if err != nil {
+		return err
+	}
+	if account.Status != AccountPendingDeletion {
+		return ErrNotPendingDeletion
+	}
+
+	account.Status = AccountActive
+	account.DeleteAfter = time.Time{}
+	_, err = datastore.Put(c, accountKey, &account)
+	return err
+}
+
+// uncache removes the account's deleted flag
+func (s *DeletionService) uncache(c context.Context, accountKey *datastore.Key) error {
+	err := memcache.Delete(c, DeletedAccountCacheKey(accountKey))
+	if err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
+	return nil
+}
+
+func (s *DeletionService) gracePeriod() time.Duration {
+	if s.GracePeriod <= 0 {
+		return DefaultDeletionGracePeriod
+	}
+	return s.GracePeriod
+}
+
+// deleteMulti deletes the keys in batches the datastore accepts
+func deleteMulti(c context.Context, keys []*datastore.Key) error {
+	for start := 0; start < len(keys); start += maxDeleteMulti {
+		end := start + maxDeleteMulti
+		if end > len(keys) {
+			end = len(keys)
+		}
+		err := datastore.DeleteMulti(c, keys[start:end])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type mockAttachmentDeleter struct {
+	deleted []string
+}
+
+func (m *mockAttachmentDeleter) Delete(c context.Context, name string) error {
+	m.deleted = append(m.deleted, name)
+	return nil
+}
+
+func TestDeletionService_Cancel(t *testing.T) {
+	c := getContext()
+	mailer := &MemoryMailer{}
+	svc := DeletionService{Mailer: mailer, RestoreURL: "https://example.com/restore?code={code}"}
+
+	astore := NewAccountStore()
+	accountKey, err := astore.Create(c, &Credentials{Username: "cancelled", Password: "foobario"}, &Account{Email: "cancelled@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tstore := NewTokenStore()
+	if _, err = tstore.Create(c, accountKey, Device{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = svc.Schedule(c, accountKey); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := tstore.GetByAccount(c, accountKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) > 0 {
+		t.Errorf("expected tokens to be revoked, got %d", len(tokens))
+	}
+
+	// deleted accounts can't sign in
+	authService := AuthService{}
+	_, err = authService.Authenticate(c, &Credentials{Username: "cancelled", Password: "foobario"})
+	if err != ErrAccountPendingDeletion {
+		t.Errorf("expected pending deletion, got %v", err)
+	}
+
+	if err = svc.SendRestoreCode(c, accountKey); err != nil {
+		t.Fatal(err)
+	}
+	messages := mailer.Messages()
+	if len(messages) != 1 || messages[0].To != "cancelled@example.com" {
+		t.Fatalf("expected restore email, got %+v", messages)
+	}
+	code := linkParam(t, messages[0].Body, "code")
+	if err = svc.Cancel(c, code); err != nil {
+		t.Fatal(err)
+	}
+
+	var account Account
+	if err = datastore.Get(c, accountKey, &account); err != nil {
+		t.Fatal(err)
+	}
+	if account.Status != AccountActive || !account.DeleteAfter.IsZero() {
+		t.Errorf("expected account to be restored, got %s", account.Status)
+	}
+	if err = svc.Cancel(c, code); err != ErrInvalidToken {
+		t.Errorf("expected used code to be rejected, got %v", err)
+	}
+	if _, err = authService.Authenticate(c, &Credentials{Username: "cancelled", Password: "foobario"}); err != nil {
+		t.Errorf("expected restored account to sign in: %v", err)
+	}
+}
+
+func TestDeletionService_Purge(t *testing.T) {
+	c := getContext()
+	now := time.Now()
+	storage := &mockAttachmentDeleter{}
+	svc := DeletionService{
+		Mailer:      &MemoryMailer{},
+		GracePeriod: time.Hour,
+		Storage:     storage,
+		Clock:       func() time.Time { return now },
+	}
+
+	astore := NewAccountStore()
+	photo := Attachment{Name: "purged-photo"}
+	account := Account{Email: "purged@example.com", Photo: photo}
+	accountKey, err := astore.Create(c, &Credentials{Username: "purged", Password: "foobario"}, &account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = (AttachmentStore{}).Record(c, accountKey, &photo); err != nil {
+		t.Fatal(err)
+	}
+	// attachment names within accounts are set by clients; only the recorded
+	// attachments are deleted
+	unrecorded := Account{Email: "unrecorded-purge@example.com", Photo: Attachment{Name: "someone-elses-photo"}}
+	unrecordedKey, err := astore.Create(c, &Credentials{Username: "unrecorded-purge", Password: "foobario"}, &unrecorded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cstore := NewCredentialStore()
+	provider := Credentials{ProviderID: "purged-id", ProviderName: "facebook", ProviderToken: "token"}
+	if _, err = cstore.Create(c, &provider, accountKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = svc.Schedule(c, accountKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = svc.Schedule(c, unrecordedKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is purged during the grace period
+	count, err := svc.Purge(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("expected no accounts to be purged, got %d", count)
+	}
+
+	now = now.Add(time.Hour * 2)
+	count, err = svc.Purge(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("expected the accounts to be purged, got %d", count)
+	}
+
+	if err = datastore.Get(c, accountKey, &account); err != datastore.ErrNoSuchEntity {
+		t.Errorf("expected account to be deleted, got %v", err)
+	}
+	children, err := datastore.NewQuery("").Ancestor(accountKey).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children) > 0 {
+		t.Errorf("expected children to be deleted, got %v", children)
+	}
+	deleted := map[string]bool{}
+	for _, name := range storage.deleted {
+		deleted[name] = true
+	}
+	if len(deleted) != 3 || !deleted["purged-photo"] || !deleted[ExportName(accountKey)] || !deleted[ExportName(unrecordedKey)] {
+		t.Errorf("expected recorded photo and exports to be deleted, got %v", storage.deleted)
+	}
+	if _, err = cstore.GetAccountKeyByProvider(c, &provider); err != errProviderNotFound {
+		t.Errorf("expected provider identity to be deleted, got %v", err)
+	}
+
+	// the username and email can be used again
+	_, err = astore.Create(c, &Credentials{Username: "purged", Password: "foobario"}, &Account{Email: "purged@example.com"})
+	if err != nil {
+		t.Errorf("expected reservations to be released: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package core
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// DefaultEmailVerificationTTL is how long verification codes are valid when
+// the verifier doesn't specify
+const DefaultEmailVerificationTTL = time.Hour * 24 * 3
+
+// ErrEmailAlreadyVerified is returned when starting the verification of an
+// email that is already verified
+var ErrEmailAlreadyVerified = NewError(Conflict, "email_already_verified", "the email is already verified")
+
+// EmailVerifier confirms that account owners receive email at their address
+type EmailVerifier struct {
+	Mailer Mailer
+	// VerifyURL is the link sent to users; `{code}` is replaced with the code
+	VerifyURL string
+	TTL       time.Duration
+}
+
+// Start emails a new verification code to the account's current email.
+// Outstanding codes are discarded, so it is also used to restart verification
+// once the email changes, which clears the verified state. Returns
+// ErrEmailAlreadyVerified if the current email is verified.
+func (v *EmailVerifier) Start(c context.Context, accountKey *datastore.Key) error {
+	var account Account
+	err := datastore.Get(c, accountKey, &account)
+	if err != nil {
+		return err
+	}
+	if !account.EmailVerified.IsZero() {
+		return ErrEmailAlreadyVerified
+	}
+
+	tstore := NewOneTimeTokenStore()
+	err = tstore.DeleteAll(c, accountKey, PurposeEmailVerification)
+	if err != nil {
+		return err
+	}
+
+	if len(account.Email) == 0 {
+		return nil
+	}
+
+	ttl := v.TTL
+	if ttl <= 0 {
+		ttl = DefaultEmailVerificationTTL
+	}
+	token, err := tstore.Create(c, accountKey, PurposeEmailVerification, account.Email, ttl)
+	if err != nil {
+		return fmt.Errorf("creating verification code: %v", err)
+	}
+
+	link := strings.Replace(v.VerifyURL, "{code}", url.QueryEscape(token.Value()), -1)
+	return v.Mailer.Send(c, &Message{
+		To:      account.Email,
+		Subject: "Verify your email",
+		Body:    fmt.Sprintf("Use the following link to verify your email address.\n\n%s\n", link),
+	})
+}
+
+// Verify marks the account's email as verified. The code must belong to the
+// account and have been sent to the account's current email.
+func (v *EmailVerifier) Verify(c context.Context, accountKey *datastore.Key, code string) error {
+	tstore := NewOneTimeTokenStore()
+	key, err := tstore.key(c, code)
+	if err != nil {
+		return err
+	}
+	if !key.Parent().Equal(accountKey) {
+		return ErrInvalidToken
+	}
+
+	// the code is consumed in the same transaction as the account is updated
+	return datastore.RunInTransaction(c, func(tc context.Context) error {
+		token, err := tstore.get(tc, key, PurposeEmailVerification)
+		if err != nil {
+			return err
+		}
+
+		var account Account
+		err = datastore.Get(tc, accountKey, &account)
+		if err != nil {
+			return err
+		}
+		if account.Email != token.Subject {
+			return ErrInvalidToken
+		}
+
+		err = datastore.Delete(tc, key)
+		if err != nil {
+			return err
+		}
+
+		account.EmailVerified = time.Now()
+		_, err = datastore.Put(tc, accountKey, &account)
+		return err
+	}, nil)
+}
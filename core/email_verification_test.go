@@ -0,0 +1,87 @@
+package core
+
+import (
+	"testing"
+
+	"google.golang.org/appengine/datastore"
+)
+
+func TestEmailVerifier_Verify(t *testing.T) {
+	c := getContext()
+	mailer := &MemoryMailer{}
+	verifier := EmailVerifier{Mailer: mailer, VerifyURL: "https://example.com/verify?code={code}"}
+
+	accountKey, err := datastore.Put(c, datastore.NewIncompleteKey(c, "accounts", nil), &Account{Email: "verify@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := datastore.Put(c, datastore.NewIncompleteKey(c, "accounts", nil), &Account{Email: "other@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = verifier.Start(c, accountKey); err != nil {
+		t.Fatal(err)
+	}
+	messages := mailer.Messages()
+	if len(messages) != 1 || messages[0].To != "verify@example.com" {
+		t.Fatalf("expected verification email to the account email, got %+v", messages)
+	}
+	code := linkParam(t, messages[0].Body, "code")
+
+	if err = verifier.Verify(c, otherKey, code); err != ErrInvalidToken {
+		t.Errorf("expected code to be rejected for another account, got %v", err)
+	}
+	if err = verifier.Verify(c, accountKey, code); err != nil {
+		t.Fatal(err)
+	}
+
+	var account Account
+	if err = datastore.Get(c, accountKey, &account); err != nil {
+		t.Fatal(err)
+	}
+	if account.EmailVerified.IsZero() {
+		t.Error("expected email to be verified")
+	}
+
+	// codes are single use
+	if err = verifier.Verify(c, accountKey, code); err != ErrInvalidToken {
+		t.Errorf("expected used code to be rejected, got %v", err)
+	}
+
+	// resending must not unverify the email
+	if err = verifier.Start(c, accountKey); err != ErrEmailAlreadyVerified {
+		t.Errorf("expected already verified, got %v", err)
+	}
+	if err = datastore.Get(c, accountKey, &account); err != nil {
+		t.Fatal(err)
+	}
+	if account.EmailVerified.IsZero() {
+		t.Error("expected email to remain verified")
+	}
+}
+
+func TestEmailVerifier_ChangedEmail(t *testing.T) {
+	c := getContext()
+	mailer := &MemoryMailer{}
+	verifier := EmailVerifier{Mailer: mailer, VerifyURL: "https://example.com/verify?code={code}"}
+
+	account := Account{Email: "before@example.com"}
+	accountKey, err := datastore.Put(c, datastore.NewIncompleteKey(c, "accounts", nil), &account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verifier.Start(c, accountKey); err != nil {
+		t.Fatal(err)
+	}
+	code := linkParam(t, mailer.Messages()[0].Body, "code")
+
+	account.Email = "after@example.com"
+	if _, err = datastore.Put(c, accountKey, &account); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = verifier.Verify(c, accountKey, code); err != ErrInvalidToken {
+		t.Errorf("expected code for a previous email to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package core
+
+import (
+	"fmt"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// ErrorKind classifies errors so callers can respond to them without
+// comparing against every error value
+type ErrorKind int
+
+// Error kinds
+const (
+	// Internal errors are unexpected failures; their details aren't shown to users
+	Internal ErrorKind = iota
+	NotFound
+	Conflict
+	Invalid
+	Unauthorized
+	Forbidden
+	// Upstream errors are failures of an external service, such as an auth provider
+	Upstream
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case NotFound:
+		return "not found"
+	case Conflict:
+		return "conflict"
+	case Invalid:
+		return "invalid"
+	case Unauthorized:
+		return "unauthorized"
+	case Forbidden:
+		return "forbidden"
+	case Upstream:
+		return "upstream"
+	default:
+		return "internal"
+	}
+}
+
+// Error is a domain error with a kind and a stable, machine readable code.
+// Package errors such as ErrInvalidCredentials are *Error values, so they can
+// still be compared directly.
+type Error struct {
+	Kind    ErrorKind
+	Code    string
+	Message string
+	// Fields lists the invalid values of Invalid errors, if known
+	Fields []FieldError
+	// Err is the underlying cause, if any
+	Err error
+}
+
+// FieldError describes why a single field's value is invalid
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// NewError creates an error of the kind
+func NewError(kind ErrorKind, code, message string) *Error {
+	return &Error{Kind: kind, Code: code, Message: message}
+}
+
+// WrapError classifies the cause as an error of the kind
+func WrapError(kind ErrorKind, code string, err error) *Error {
+	return &Error{Kind: kind, Code: code, Message: err.Error(), Err: err}
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil && e.Err.Error() != e.Message {
+		return fmt.Sprintf("%s: %v", e.Message, e.Err)
+	}
+	return e.Message
+}
+
+// FieldsOf returns the field level details of the error, if any
+func FieldsOf(err error) []FieldError {
+	if e, ok := err.(*Error); ok {
+		return e.Fields
+	}
+	return nil
+}
+
+// KindOf returns the kind of the error; errors that aren't classified are
+// Internal
+func KindOf(err error) ErrorKind {
+	switch e := err.(type) {
+	case *Error:
+		return e.Kind
+	}
+	if err == datastore.ErrNoSuchEntity {
+		return NotFound
+	}
+	return Internal
+}
+
+// CodeOf returns the error's code, falling back to a code for its kind
+func CodeOf(err error) string {
+	if e, ok := err.(*Error); ok && len(e.Code) > 0 {
+		return e.Code
+	}
+	switch KindOf(err) {
+	case NotFound:
+		return "not_found"
+	case Conflict:
+		return "conflict"
+	case Invalid:
+		return "invalid"
+	case Unauthorized:
+		return "unauthorized"
+	case Forbidden:
+		return "forbidden"
+	case Upstream:
+		return "upstream_error"
+	default:
+		return "internal_error"
+	}
+}
@@ -0,0 +1,47 @@
+package core
+
+import (
+	"errors"
+	"testing"
+
+	"google.golang.org/appengine/datastore"
+)
+
+func TestKindOf(t *testing.T) {
+	type data struct {
+		name string
+		err  error
+		kind ErrorKind
+		code string
+	}
+
+	tests := []data{
+		data{name: "sentinel", err: ErrUsernameTaken, kind: Conflict, code: "username_taken"},
+		data{name: "wrapped", err: WrapError(Upstream, "provider_unavailable", errors.New("timeout")), kind: Upstream, code: "provider_unavailable"},
+		data{name: "missing entity", err: datastore.ErrNoSuchEntity, kind: NotFound, code: "not_found"},
+		data{name: "unclassified", err: errors.New("boom"), kind: Internal, code: "internal_error"},
+	}
+
+	for _, test := range tests {
+		if kind := KindOf(test.err); kind != test.kind {
+			t.Errorf("%s: expected kind %v, got %v", test.name, test.kind, kind)
+		}
+		if code := CodeOf(test.err); code != test.code {
+			t.Errorf("%s: expected code %s, got %s", test.name, test.code, code)
+		}
+	}
+}
+
+func TestAuthService_VerifyUpstream(t *testing.T) {
+	c := getContext()
+	svc := AuthService{
+		URLGetter: mockURLGetter{err: errors.New("connection refused")},
+		Providers: AuthProviders{"facebook": FacebookProvider{AppID: "app-id", AppSecret: "secret"}},
+	}
+
+	// provider outages aren't reported as invalid credentials
+	_, err := svc.Verify(c, &Credentials{ProviderName: "facebook", ProviderID: "1234", ProviderToken: "token"})
+	if KindOf(err) != Upstream {
+		t.Errorf("expected upstream error, got %v", err)
+	}
+}
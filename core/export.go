@@ -0,0 +1,295 @@
+package core
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+const exportsTable = "exports"
+
+// accounts only have one export, so its key name is fixed
+const exportKeyName = "latest"
+
+// DefaultExportTTL is how long exports can be downloaded when the service
+// doesn't specify
+const DefaultExportTTL = time.Hour * 24 * 7
+
+// ExportDownloadCodeTTL is how long download codes can be used
+var ExportDownloadCodeTTL = time.Minute * 5
+
+// how long a requested export can take to build before another can be requested
+const exportBuildTimeout = time.Hour
+
+// Export errors
+var (
+	ErrExportMissingEmail = NewError(Invalid, "missing_email", "the account has no email to send the export to")
+	ErrExportInProgress   = NewError(Conflict, "export_in_progress", "the account's export is still being built")
+	ErrExportExists       = NewError(Conflict, "export_exists", "the account's latest export can still be downloaded")
+	ErrExportNotFound     = NewError(NotFound, "export_not_found", "the account has no export to download")
+)
+
+// ExportService builds archives of all of an account's personal data. Archives
+// are kept until the account's next export replaces it or the account is purged.
+type ExportService struct {
+	// Storage holds the account's attachments and the built archives
+	Storage Storage
+	Mailer  Mailer
+	// DownloadURL is the page, linked in the email, where users download the
+	// archive
+	DownloadURL string
+	// TTL is how long archives can be downloaded
+	TTL   time.Duration
+	Clock Clock
+}
+
+// accountExport tracks the account's latest export
+type accountExport struct {
+	Requested time.Time `datastore:",noindex"`
+	Built     time.Time `datastore:",noindex"`
+	Expiry    time.Time `datastore:",noindex"`
+}
+
+// exportCredentials is the exported view of credentials; secrets are left out
+type exportCredentials struct {
+	ProviderName string `json:"providerName,omitempty"`
+	ProviderID   string `json:"providerId,omitempty"`
+	Username     string `json:"username,omitempty"`
+}
+
+// exportSession is the exported view of a token; token values are left out
+type exportSession struct {
+	IssuedAt   time.Time `json:"issuedAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	Expiry     time.Time `json:"expiry"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+}
+
+// ExportName is the name the account's archive is stored with; newer exports
+// replace older ones
+func ExportName(accountKey *datastore.Key) string {
+	return "exports/" + accountKey.Encode() + ".zip"
+}
+
+// Request records that the account's export is being built. Each account can
+// only request one export at a time, and not while its latest export can still
+// be downloaded, since each export is a full archive build and an email.
+func (s *ExportService) Request(c context.Context, accountKey *datastore.Key) error {
+	key := s.key(c, accountKey)
+	now := s.Clock.Now()
+	return datastore.RunInTransaction(c, func(tc context.Context) error {
+		var export accountExport
+		err := datastore.Get(tc, key, &export)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if export.Requested.After(export.Built) && now.Sub(export.Requested) < exportBuildTimeout {
+			return ErrExportInProgress
+		}
+		if export.Expiry.After(now) {
+			return ErrExportExists
+		}
+
+		export.Requested = now
+		_, err = datastore.Put(tc, key, &export)
+		return err
+	}, nil)
+}
+
+// Export builds and stores the account's archive, then emails the account that
+// it can be downloaded until it expires after the TTL
+func (s *ExportService) Export(c context.Context, accountKey *datastore.Key) error {
+	var account Account
+	err := datastore.Get(c, accountKey, &account)
+	if err != nil {
+		return err
+	}
+	if len(account.Email) == 0 {
+		return ErrExportMissingEmail
+	}
+
+	data, err := s.Archive(c, accountKey)
+	if err != nil {
+		return err
+	}
+	err = s.Storage.Write(c, ExportName(accountKey), "application/zip", data)
+	if err != nil {
+		return fmt.Errorf("storing archive: %v", err)
+	}
+
+	// codes for older archives are no longer valid
+	tstore := NewOneTimeTokenStore()
+	err = tstore.DeleteAll(c, accountKey, PurposeExport)
+	if err != nil {
+		return err
+	}
+
+	ttl := s.TTL
+	if ttl <= 0 {
+		ttl = DefaultExportTTL
+	}
+	now := s.Clock.Now()
+	export := accountExport{Requested: now, Built: now, Expiry: now.Add(ttl)}
+	_, err = datastore.Put(c, s.key(c, accountKey), &export)
+	if err != nil {
+		return fmt.Errorf("saving export: %v", err)
+	}
+
+	return s.Mailer.Send(c, &Message{
+		To:      account.Email,
+		Subject: "Your data export is ready",
+		Body: fmt.Sprintf("Your data export can be downloaded from the following page until %s.\n\n%s\n",
+			export.Expiry.Format("January 2, 2006"), s.DownloadURL),
+	})
+}
+
+// DownloadCode returns a short-lived code that downloads the account's archive
+// once, so the code can be used in a download link
+func (s *ExportService) DownloadCode(c context.Context, accountKey *datastore.Key) (*OneTimeToken, error) {
+	_, err := s.latest(c, accountKey)
+	if err != nil {
+		return nil, err
+	}
+	tstore := NewOneTimeTokenStore()
+	return tstore.Create(c, accountKey, PurposeExport, "", ExportDownloadCodeTTL)
+}
+
+// Download returns the archive of the account the unexpired download code
+// belongs to. Each code can only be used once.
+func (s *ExportService) Download(c context.Context, code string) ([]byte, error) {
+	tstore := NewOneTimeTokenStore()
+	token, err := tstore.Consume(c, code, PurposeExport)
+	if err != nil {
+		return nil, err
+	}
+	accountKey := token.Key.Parent()
+
+	_, err = s.latest(c, accountKey)
+	if err != nil {
+		return nil, err
+	}
+	return s.Storage.Read(c, ExportName(accountKey))
+}
+
+// latest returns the account's export, or ErrExportNotFound if it has expired
+// or hasn't been built
+func (s *ExportService) latest(c context.Context, accountKey *datastore.Key) (*accountExport, error) {
+	var export accountExport
+	err := datastore.Get(c, s.key(c, accountKey), &export)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrExportNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if export.Built.IsZero() || !export.Expiry.After(s.Clock.Now()) {
+		return nil, ErrExportNotFound
+	}
+	return &export, nil
+}
+
+func (s *ExportService) key(c context.Context, accountKey *datastore.Key) *datastore.Key {
+	return datastore.NewKey(c, exportsTable, exportKeyName, 0, accountKey)
+}
+
+// Archive returns the zip of the account, its credentials without secrets, its
+// sessions and the original data of its recorded attachments
+func (s *ExportService) Archive(c context.Context, accountKey *datastore.Key) ([]byte, error) {
+	var account Account
+	err := datastore.Get(c, accountKey, &account)
+	if err != nil {
+		return nil, err
+	}
+	account.Key = accountKey
+
+	cstore := NewCredentialStore()
+	var creds []*Credentials
+	_, err = cstore.GetByParent(c, accountKey, &creds)
+	if err != nil {
+		return nil, fmt.Errorf("getting credentials: %v", err)
+	}
+	exportCreds := []exportCredentials{}
+	for _, cr := range creds {
+		exportCreds = append(exportCreds, exportCredentials{
+			ProviderName: cr.ProviderName,
+			ProviderID:   cr.ProviderID,
+			Username:     cr.Username,
+		})
+	}
+
+	tstore := NewTokenStore()
+	tokens, err := tstore.GetByAccount(c, accountKey)
+	if err != nil {
+		return nil, fmt.Errorf("getting sessions: %v", err)
+	}
+	sessions := []exportSession{}
+	for _, t := range tokens {
+		sessions = append(sessions, exportSession{
+			IssuedAt:   t.IssuedAt,
+			LastUsedAt: t.LastUsedAt,
+			Expiry:     t.Expiry,
+			UserAgent:  t.UserAgent,
+			IP:         t.IP,
+		})
+	}
+
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	files := []struct {
+		name string
+		v    interface{}
+	}{
+		{"account.json", &account},
+		{"credentials.json", exportCreds},
+		{"sessions.json", sessions},
+	}
+	for _, f := range files {
+		data, err := json.MarshalIndent(f.v, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		err = writeZipFile(z, f.name, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	names, err := AttachmentStore{}.Recorded(c, accountKey)
+	if err != nil {
+		return nil, fmt.Errorf("getting attachments: %v", err)
+	}
+	for _, name := range names {
+		data, err := s.Storage.Read(c, name)
+		if err == ErrObjectNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading attachment %s: %v", name, err)
+		}
+		err = writeZipFile(z, "attachments/"+name, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = z.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeZipFile(z *zip.Writer, name string, data []byte) error {
+	w, err := z.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
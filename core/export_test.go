@@ -0,0 +1,204 @@
+package core
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportService_Export(t *testing.T) {
+	c := getContext()
+	storage := &MemoryStorage{}
+	mailer := &MemoryMailer{}
+	svc := ExportService{Storage: storage, Mailer: mailer, DownloadURL: "https://example.com/export"}
+
+	if err := storage.Write(c, "exported-photo", "image/png", []byte("photo data")); err != nil {
+		t.Fatal(err)
+	}
+	astore := NewAccountStore()
+	photo := Attachment{Name: "exported-photo", Type: "image/png"}
+	account := Account{Email: "exported@example.com", FirstName: "Jim", Photo: photo}
+	accountKey, err := astore.Create(c, &Credentials{Username: "exported", Password: "foobario"}, &account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = (AttachmentStore{}).Record(c, accountKey, &photo); err != nil {
+		t.Fatal(err)
+	}
+	tstore := NewTokenStore()
+	if _, err = tstore.Create(c, accountKey, Device{UserAgent: "export-agent"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing to download until it is built
+	if _, err = svc.DownloadCode(c, accountKey); err != ErrExportNotFound {
+		t.Errorf("expected export not found, got %v", err)
+	}
+
+	if err = svc.Request(c, accountKey); err != nil {
+		t.Fatal(err)
+	}
+	if err = svc.Request(c, accountKey); err != ErrExportInProgress {
+		t.Errorf("expected export in progress, got %v", err)
+	}
+	if err = svc.Export(c, accountKey); err != nil {
+		t.Fatal(err)
+	}
+	if err = svc.Request(c, accountKey); err != ErrExportExists {
+		t.Errorf("expected export to exist, got %v", err)
+	}
+
+	messages := mailer.Messages()
+	if len(messages) != 1 || messages[0].To != "exported@example.com" {
+		t.Fatalf("expected export email, got %+v", messages)
+	}
+	if !strings.Contains(messages[0].Body, "https://example.com/export\n") {
+		t.Errorf("expected download page link without a code, got %s", messages[0].Body)
+	}
+
+	token, err := svc.DownloadCode(c, accountKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Expiry.After(time.Now().Add(ExportDownloadCodeTTL)) {
+		t.Errorf("expected short-lived download code, got %v", token.Expiry)
+	}
+	data, err := svc.Download(c, token.Value())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range z.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(b)
+	}
+
+	var exported Account
+	if err = json.Unmarshal([]byte(files["account.json"]), &exported); err != nil {
+		t.Fatal(err)
+	}
+	if exported.Email != "exported@example.com" || exported.FirstName != "Jim" {
+		t.Errorf("expected exported account, got %+v", exported)
+	}
+	if !strings.Contains(files["credentials.json"], `"username": "exported"`) {
+		t.Errorf("expected exported credentials, got %s", files["credentials.json"])
+	}
+	if strings.Contains(strings.ToLower(files["credentials.json"]), "password") {
+		t.Errorf("expected credential secrets to be left out, got %s", files["credentials.json"])
+	}
+	if !strings.Contains(files["sessions.json"], "export-agent") {
+		t.Errorf("expected exported sessions, got %s", files["sessions.json"])
+	}
+	if files["attachments/exported-photo"] != "photo data" {
+		t.Errorf("expected exported photo, got %q", files["attachments/exported-photo"])
+	}
+
+	// download codes are single use
+	if _, err = svc.Download(c, token.Value()); err != ErrInvalidToken {
+		t.Errorf("expected used code to be rejected, got %v", err)
+	}
+	if _, err = svc.Download(c, "invalid"); err == nil {
+		t.Error("expected invalid code to be rejected")
+	}
+}
+
+func TestExportService_ExportMissingEmail(t *testing.T) {
+	c := getContext()
+	svc := ExportService{Storage: &MemoryStorage{}, Mailer: &MemoryMailer{}}
+
+	astore := NewAccountStore()
+	accountKey, err := astore.Create(c, &Credentials{Username: "noemail", Password: "foobario"}, &Account{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = svc.Export(c, accountKey); err != ErrExportMissingEmail {
+		t.Errorf("expected missing email, got %v", err)
+	}
+}
+
+func TestExportService_ArchiveUnrecordedAttachments(t *testing.T) {
+	c := getContext()
+	storage := &MemoryStorage{}
+	svc := ExportService{Storage: storage, Mailer: &MemoryMailer{}}
+
+	// attachment names within accounts are set by clients
+	if err := storage.Write(c, "someone-elses-photo", "image/png", []byte("photo data")); err != nil {
+		t.Fatal(err)
+	}
+	astore := NewAccountStore()
+	account := Account{Email: "unrecorded@example.com", Photo: Attachment{Name: "someone-elses-photo"}}
+	accountKey, err := astore.Create(c, &Credentials{Username: "unrecorded", Password: "foobario"}, &account)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := svc.Archive(c, accountKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range z.File {
+		if strings.HasPrefix(f.Name, "attachments/") {
+			t.Errorf("expected unrecorded attachment to be left out, got %s", f.Name)
+		}
+	}
+}
+
+func TestExportService_Expiry(t *testing.T) {
+	c := getContext()
+	now := time.Now()
+	svc := ExportService{
+		Storage: &MemoryStorage{},
+		Mailer:  &MemoryMailer{},
+		TTL:     time.Hour,
+		Clock:   func() time.Time { return now },
+	}
+
+	astore := NewAccountStore()
+	accountKey, err := astore.Create(c, &Credentials{Username: "expired-export", Password: "foobario"}, &Account{Email: "expired-export@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = svc.Request(c, accountKey); err != nil {
+		t.Fatal(err)
+	}
+	if err = svc.Export(c, accountKey); err != nil {
+		t.Fatal(err)
+	}
+	token, err := svc.DownloadCode(c, accountKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// expired exports can't be downloaded, but can be requested again
+	now = now.Add(time.Hour * 2)
+	if _, err = svc.Download(c, token.Value()); err != ErrExportNotFound {
+		t.Errorf("expected expired export to be rejected, got %v", err)
+	}
+	if _, err = svc.DownloadCode(c, accountKey); err != ErrExportNotFound {
+		t.Errorf("expected expired export to be rejected, got %v", err)
+	}
+	if err = svc.Request(c, accountKey); err != nil {
+		t.Errorf("expected new export to be allowed: %v", err)
+	}
+}
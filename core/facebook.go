@@ -0,0 +1,143 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const facebookGraphURL = "https://graph.facebook.com"
+
+// FacebookProvider verifies Facebook access tokens with the Graph API. Tokens
+// must have been issued to the configured app to prevent tokens obtained by
+// other apps from being used to sign in.
+type FacebookProvider struct {
+	AppID     string
+	AppSecret string
+	Clock     Clock
+}
+
+// Name .
+func (p FacebookProvider) Name() string {
+	return "facebook"
+}
+
+// Verify inspects the access token with the debug_token endpoint, then fetches
+// the user the token belongs to
+func (p FacebookProvider) Verify(c context.Context, getter URLGetter, creds *Credentials) (*Identity, error) {
+	if len(p.AppID) == 0 || len(p.AppSecret) == 0 {
+		return nil, errors.New("facebook: app id and secret are required")
+	}
+
+	userID, err := p.debugToken(getter, creds.ProviderToken)
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+	params.Set("fields", "id,name,email,picture")
+	params.Set("access_token", creds.ProviderToken)
+	params.Set("appsecret_proof", p.appSecretProof(creds.ProviderToken))
+
+	var me struct {
+		ID      string `json:"id"`
+		Name    string `json:"name"`
+		Email   string `json:"email"`
+		Picture struct {
+			Data struct {
+				URL string `json:"url"`
+			} `json:"data"`
+		} `json:"picture"`
+	}
+	err = facebookGet(getter, "/me?"+params.Encode(), &me)
+	if err != nil {
+		return nil, err
+	}
+
+	if me.ID != userID {
+		return nil, errors.New("facebook: token user doesn't match the fetched user")
+	}
+
+	return &Identity{
+		ProviderID: me.ID,
+		Email:      me.Email,
+		Name:       me.Name,
+		Picture:    me.Picture.Data.URL,
+	}, nil
+}
+
+// debugToken ensures the token is valid, unexpired and was issued to our app
+// and returns the id of the user it was issued for
+func (p FacebookProvider) debugToken(getter URLGetter, token string) (string, error) {
+	params := url.Values{}
+	params.Set("input_token", token)
+	params.Set("access_token", p.AppID+"|"+p.AppSecret)
+
+	var debug struct {
+		Data struct {
+			AppID     string `json:"app_id"`
+			UserID    string `json:"user_id"`
+			IsValid   bool   `json:"is_valid"`
+			ExpiresAt int64  `json:"expires_at"`
+		} `json:"data"`
+	}
+	err := facebookGet(getter, "/debug_token?"+params.Encode(), &debug)
+	if err != nil {
+		return "", err
+	}
+
+	d := debug.Data
+	if !d.IsValid {
+		return "", errors.New("facebook: token is not valid")
+	}
+	if d.AppID != p.AppID {
+		return "", fmt.Errorf("facebook: token was issued to app %s", d.AppID)
+	}
+	// tokens that never expire have an expires_at of 0
+	if d.ExpiresAt > 0 && !p.Clock.Now().Before(time.Unix(d.ExpiresAt, 0)) {
+		return "", errors.New("facebook: token has expired")
+	}
+	if len(d.UserID) == 0 {
+		return "", errors.New("facebook: no user id returned")
+	}
+
+	return d.UserID, nil
+}
+
+// appSecretProof signs the access token with the app secret
+func (p FacebookProvider) appSecretProof(token string) string {
+	mac := hmac.New(sha256.New, []byte(p.AppSecret))
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// facebookGet performs a Graph API request and decodes the response into dst
+func facebookGet(getter URLGetter, path string, dst interface{}) error {
+	resp, err := getter.Get(facebookGraphURL + path)
+	if err != nil {
+		return WrapError(Upstream, "provider_unavailable", fmt.Errorf("facebook: %v", err))
+	}
+	defer resp.Body.Close()
+
+	// invalid tokens are rejected with 4xx responses
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return WrapError(Upstream, "provider_unavailable", fmt.Errorf("facebook: unexpected status %d", resp.StatusCode))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("facebook: unexpected status %d", resp.StatusCode)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(dst)
+	if err != nil {
+		return fmt.Errorf("facebook: decoding response: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// facebookGetter stubs the debug_token and /me Graph API responses
+func facebookGetter(appID, userID, me string) mockRouteGetter {
+	debug := fmt.Sprintf(`{"data": {"app_id": %q, "user_id": %q, "is_valid": true, "expires_at": 0}}`, appID, userID)
+	return mockRouteGetter{
+		"/debug_token": mockURLGetter{body: debug, status: http.StatusOK},
+		"/me":          mockURLGetter{body: me, status: http.StatusOK},
+	}
+}
+
+// recordingGetter keeps the requested urls
+type recordingGetter struct {
+	getter URLGetter
+	urls   *[]string
+}
+
+func (r recordingGetter) Get(url string) (*http.Response, error) {
+	*r.urls = append(*r.urls, url)
+	return r.getter.Get(url)
+}
+
+func TestFacebookProvider_Verify(t *testing.T) {
+	c := getContext()
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	provider := FacebookProvider{
+		AppID:     "app-id",
+		AppSecret: "secret",
+		Clock:     func() time.Time { return now },
+	}
+
+	debug := func(appID string, valid bool, expiresAt int64) mockURLGetter {
+		body := fmt.Sprintf(`{"data": {"app_id": %q, "user_id": "1234", "is_valid": %v, "expires_at": %d}}`, appID, valid, expiresAt)
+		return mockURLGetter{body: body, status: http.StatusOK}
+	}
+	me := mockURLGetter{body: `{"id": "1234", "name": "Bob"}`, status: http.StatusOK}
+
+	type fbTest struct {
+		name   string
+		getter URLGetter
+		ok     bool
+	}
+	tests := []fbTest{
+		{name: "valid", getter: mockRouteGetter{"/debug_token": debug("app-id", true, 0), "/me": me}, ok: true},
+		{name: "valid with expiry", getter: mockRouteGetter{"/debug_token": debug("app-id", true, now.Add(time.Hour).Unix()), "/me": me}, ok: true},
+		{name: "issued to another app", getter: mockRouteGetter{"/debug_token": debug("other-app", true, 0), "/me": me}},
+		{name: "invalid token", getter: mockRouteGetter{"/debug_token": debug("app-id", false, 0), "/me": me}},
+		{name: "expired token", getter: mockRouteGetter{"/debug_token": debug("app-id", true, now.Add(-time.Hour).Unix()), "/me": me}},
+		{name: "mismatched user", getter: mockRouteGetter{"/debug_token": debug("app-id", true, 0), "/me": mockURLGetter{body: `{"id": "4321"}`, status: http.StatusOK}}},
+	}
+
+	for _, test := range tests {
+		creds := Credentials{ProviderName: "facebook", ProviderID: "1234", ProviderToken: "user-token"}
+		identity, err := provider.Verify(c, test.getter, &creds)
+		if test.ok && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: expected error", test.name)
+			continue
+		}
+		if test.ok && identity.ProviderID != "1234" {
+			t.Errorf("%s: unexpected identity %+v", test.name, identity)
+		}
+	}
+}
+
+func TestFacebookProvider_AppSecretProof(t *testing.T) {
+	c := getContext()
+	provider := FacebookProvider{AppID: "app-id", AppSecret: "secret"}
+
+	var urls []string
+	getter := recordingGetter{getter: facebookGetter("app-id", "1234", `{"id": "1234"}`), urls: &urls}
+	creds := Credentials{ProviderName: "facebook", ProviderID: "1234", ProviderToken: "user-token"}
+	if _, err := provider.Verify(c, getter, &creds); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(urls) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(urls))
+	}
+	u, err := url.Parse(urls[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof := u.Query().Get("appsecret_proof")
+	if proof != provider.appSecretProof("user-token") || len(proof) != 64 {
+		t.Errorf("unexpected appsecret_proof %q", proof)
+	}
+}
+
+func TestFacebookProvider_RequiresAppCredentials(t *testing.T) {
+	c := getContext()
+	provider := FacebookProvider{}
+	creds := Credentials{ProviderName: "facebook", ProviderID: "1234", ProviderToken: "user-token"}
+	if _, err := provider.Verify(c, facebookGetter("", "1234", `{"id": "1234"}`), &creds); err == nil {
+		t.Error("expected unconfigured provider to fail")
+	}
+}
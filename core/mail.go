@@ -0,0 +1,57 @@
+package core
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/mail"
+)
+
+// Message is an email sent to a user
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails; allows the mail service to be swapped out for testing
+type Mailer interface {
+	Send(c context.Context, msg *Message) error
+}
+
+// AppEngineMailer sends emails with the App Engine mail service
+type AppEngineMailer struct {
+	// Sender must be an authorized sender of the app
+	Sender string
+}
+
+// Send .
+func (m AppEngineMailer) Send(c context.Context, msg *Message) error {
+	return mail.Send(c, &mail.Message{
+		Sender:  m.Sender,
+		To:      []string{msg.To},
+		Subject: msg.Subject,
+		Body:    msg.Body,
+	})
+}
+
+// MemoryMailer keeps sent emails in memory instead of sending them
+type MemoryMailer struct {
+	mu       sync.Mutex
+	messages []*Message
+}
+
+// Send .
+func (m *MemoryMailer) Send(c context.Context, msg *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// Messages returns the sent messages
+func (m *MemoryMailer) Messages() []*Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*Message(nil), m.messages...)
+}
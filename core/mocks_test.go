@@ -1,6 +1,13 @@
 package core
 
-import "net/http"
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
 
 // mockURLGetter - allows stubbing out any external http calls via the http.Get,
 // urlfetch.Get or other methods that match the interface
@@ -14,7 +21,7 @@ func (u mockURLGetter) Get(url string) (*http.Response, error) {
 	if u.err != nil {
 		return nil, u.err
 	}
-	r := http.Response{Body: mockReadCloser{err: u.err, data: []byte(u.body)}}
+	r := http.Response{Body: &mockReadCloser{data: bytes.NewBufferString(u.body)}}
 	r.StatusCode = u.status
 	return &r, nil
 }
@@ -22,18 +29,42 @@ func (u mockURLGetter) Get(url string) (*http.Response, error) {
 // mockReadCloser - Used within the mockURLGetter to stub out response data.
 type mockReadCloser struct {
 	err  error
-	data []byte
+	data *bytes.Buffer
 }
 
-func (m mockReadCloser) Read(data []byte) (int, error) {
+func (m *mockReadCloser) Read(data []byte) (int, error) {
 	if m.err != nil {
 		return 0, m.err
 	}
-
-	copy(data, m.data)
-	return len(m.data), nil
+	return m.data.Read(data)
 }
 
-func (m mockReadCloser) Close() error {
+func (m *mockReadCloser) Close() error {
 	return nil
 }
+
+// mockRouteGetter - stubs out the responses of multiple urls. The first route
+// whose key is contained within the requested url is used.
+type mockRouteGetter map[string]mockURLGetter
+
+func (m mockRouteGetter) Get(url string) (*http.Response, error) {
+	for route, getter := range m {
+		if strings.Contains(url, route) {
+			return getter.Get(url)
+		}
+	}
+	return nil, fmt.Errorf("no mock route for %s", url)
+}
+
+// linkParam returns the query parameter of the first link in the email body
+func linkParam(t *testing.T, body, name string) string {
+	i := strings.Index(body, "https://")
+	if i < 0 {
+		t.Fatalf("no link in email: %s", body)
+	}
+	link, err := url.Parse(strings.Fields(body[i:])[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return link.Query().Get(name)
+}
@@ -0,0 +1,294 @@
+package core
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// allowed difference between our clock and the issuer's
+	oidcClockSkew = time.Minute
+	// how long fetched keys are used when the response doesn't specify
+	defaultJWKSTTL = time.Hour
+	// minimum time between fetches triggered by an unknown key id
+	minJWKSRefresh = time.Minute
+)
+
+// OIDCProvider verifies OpenID Connect ID tokens signed with RS256 against the
+// issuer's published JSON Web Key Set. The token's subject is used as the
+// credentials' ProviderID.
+type OIDCProvider struct {
+	// ProviderName is matched against Credentials.ProviderName
+	ProviderName string
+	// Issuers are the accepted `iss` claim values
+	Issuers []string
+	// JWKSURL is the location of the issuer's signing keys
+	JWKSURL string
+	// ClientIDs are the accepted `aud` claim values
+	ClientIDs []string
+	Clock     Clock
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	expiry    time.Time
+	fetchedAt time.Time
+}
+
+// NewGoogleProvider creates a provider accepting Google Sign-In ID tokens issued
+// to any of the client ids
+func NewGoogleProvider(clientIDs ...string) *OIDCProvider {
+	return &OIDCProvider{
+		ProviderName: "google",
+		Issuers:      []string{"https://accounts.google.com", "accounts.google.com"},
+		JWKSURL:      "https://www.googleapis.com/oauth2/v3/certs",
+		ClientIDs:    clientIDs,
+	}
+}
+
+// Name .
+func (p *OIDCProvider) Name() string {
+	return p.ProviderName
+}
+
+// idClaims are the ID token claims that are verified or mapped to an identity
+type idClaims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	Expiry        int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+	Picture       string   `json:"picture"`
+}
+
+// audience handles the `aud` claim being either a string or list of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var multi []string
+	if err := json.Unmarshal(data, &multi); err != nil {
+		return err
+	}
+	*a = audience(multi)
+	return nil
+}
+
+// Verify validates the ID token's signature and claims. The credentials' nonce
+// must match the token's nonce claim; both are blank for tokens requested
+// without one.
+func (p *OIDCProvider) Verify(c context.Context, getter URLGetter, creds *Credentials) (*Identity, error) {
+	parts := strings.Split(creds.ProviderToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("oidc: malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("oidc: decoding header: %v", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("oidc: unsupported algorithm %q", header.Alg)
+	}
+
+	key, err := p.key(getter, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("oidc: decoding signature: %v", err)
+	}
+	hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], sig); err != nil {
+		return nil, fmt.Errorf("oidc: invalid signature: %v", err)
+	}
+
+	var claims idClaims
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("oidc: decoding claims: %v", err)
+	}
+	if err = p.validateClaims(&claims, creds.Nonce); err != nil {
+		return nil, err
+	}
+
+	identity := Identity{
+		ProviderID: claims.Subject,
+		Name:       claims.Name,
+		Picture:    claims.Picture,
+	}
+	if claims.EmailVerified {
+		identity.Email = claims.Email
+	}
+	return &identity, nil
+}
+
+func (p *OIDCProvider) validateClaims(claims *idClaims, nonce string) error {
+	now := p.Clock.Now()
+
+	if !containsString(p.Issuers, claims.Issuer) {
+		return fmt.Errorf("oidc: unexpected issuer %q", claims.Issuer)
+	}
+
+	validAudience := false
+	for _, aud := range claims.Audience {
+		if containsString(p.ClientIDs, aud) {
+			validAudience = true
+			break
+		}
+	}
+	if !validAudience {
+		return errors.New("oidc: token was not issued for this app")
+	}
+
+	if now.Add(-oidcClockSkew).After(time.Unix(claims.Expiry, 0)) {
+		return errors.New("oidc: token has expired")
+	}
+	if claims.IssuedAt > 0 && now.Add(oidcClockSkew).Before(time.Unix(claims.IssuedAt, 0)) {
+		return errors.New("oidc: token issued in the future")
+	}
+
+	// tokens requested with a nonce can't be replayed without it
+	if nonce != claims.Nonce {
+		return errors.New("oidc: nonce mismatch")
+	}
+
+	if len(claims.Subject) == 0 {
+		return errors.New("oidc: missing subject")
+	}
+
+	return nil
+}
+
+// key returns the cached signing key for the key id, refetching the key set
+// when the cache has expired or the key id is unknown
+func (p *OIDCProvider) key(getter URLGetter, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.Clock.Now()
+	key, ok := p.keys[kid]
+	if ok && now.Before(p.expiry) {
+		return key, nil
+	}
+
+	// prevent unknown key ids from causing a fetch on every request
+	if !ok && p.keys != nil && now.Before(p.expiry) && now.Sub(p.fetchedAt) < minJWKSRefresh {
+		return nil, fmt.Errorf("oidc: unknown key id %q", kid)
+	}
+
+	if err := p.fetchKeys(getter, now); err != nil {
+		return nil, err
+	}
+
+	key, ok = p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("oidc: unknown key id %q", kid)
+	}
+	return key, nil
+}
+
+func (p *OIDCProvider) fetchKeys(getter URLGetter, now time.Time) error {
+	resp, err := getter.Get(p.JWKSURL)
+	if err != nil {
+		return WrapError(Upstream, "provider_unavailable", fmt.Errorf("oidc: fetching keys: %v", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return WrapError(Upstream, "provider_unavailable", fmt.Errorf("oidc: fetching keys: unexpected status %d", resp.StatusCode))
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return fmt.Errorf("oidc: decoding keys: %v", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return fmt.Errorf("oidc: decoding key modulus: %v", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return fmt.Errorf("oidc: decoding key exponent: %v", err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	p.keys = keys
+	p.fetchedAt = now
+	p.expiry = now.Add(maxAge(resp.Header, defaultJWKSTTL))
+	return nil
+}
+
+// maxAge returns the Cache-Control max-age of the response headers
+func maxAge(h http.Header, fallback time.Duration) time.Duration {
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(directive)
+		if !strings.HasPrefix(directive, "max-age=") {
+			continue
+		}
+		seconds, err := strconv.Atoi(directive[len("max-age="):])
+		if err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return fallback
+}
+
+// decodeSegment decodes a base64url encoded JSON token segment into dst
+func decodeSegment(segment string, dst interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dst)
+}
+
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+package core
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// signIDToken creates an RS256 signed JWT with the claims
+func signIDToken(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	hashed := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// jwksFixture returns the JSON Web Key Set containing the key's public key
+func jwksFixture(key *rsa.PrivateKey, kid string) string {
+	n := base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+	e := base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	return fmt.Sprintf(`{"keys": [{"kid": %q, "kty": "RSA", "alg": "RS256", "n": %q, "e": %q}]}`, kid, n, e)
+}
+
+func TestOIDCProvider_Verify(t *testing.T) {
+	c := getContext()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	getter := mockURLGetter{body: jwksFixture(key, "key1"), status: http.StatusOK}
+
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		cl := map[string]interface{}{
+			"iss":            "https://accounts.google.com",
+			"aud":            "client-id",
+			"sub":            "1234",
+			"exp":            now.Add(time.Hour).Unix(),
+			"iat":            now.Unix(),
+			"nonce":          "n-0S6",
+			"email":          "bob@example.com",
+			"email_verified": true,
+		}
+		for k, v := range overrides {
+			cl[k] = v
+		}
+		return cl
+	}
+
+	type oidcTest struct {
+		name  string
+		token string
+		nonce string
+		ok    bool
+	}
+	tests := []oidcTest{
+		{name: "valid", token: signIDToken(t, key, "key1", claims(nil)), nonce: "n-0S6", ok: true},
+		{name: "valid without nonce", token: signIDToken(t, key, "key1", claims(map[string]interface{}{"nonce": ""})), ok: true},
+		{name: "missing nonce", token: signIDToken(t, key, "key1", claims(nil))},
+		{name: "unexpected nonce", token: signIDToken(t, key, "key1", claims(map[string]interface{}{"nonce": ""})), nonce: "n-0S6"},
+		{name: "audience list", token: signIDToken(t, key, "key1", claims(map[string]interface{}{"aud": []string{"other", "client-id"}})), nonce: "n-0S6", ok: true},
+		{name: "wrong audience", token: signIDToken(t, key, "key1", claims(map[string]interface{}{"aud": "other"}))},
+		{name: "wrong issuer", token: signIDToken(t, key, "key1", claims(map[string]interface{}{"iss": "https://evil.example.com"}))},
+		{name: "expired", token: signIDToken(t, key, "key1", claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()}))},
+		{name: "nonce mismatch", token: signIDToken(t, key, "key1", claims(nil)), nonce: "other"},
+		{name: "wrong signing key", token: signIDToken(t, otherKey, "key1", claims(nil))},
+		{name: "unknown key id", token: signIDToken(t, key, "key2", claims(nil))},
+		{name: "malformed", token: "foo.bar"},
+	}
+
+	provider := NewGoogleProvider("client-id")
+	provider.Clock = func() time.Time { return now }
+
+	for _, test := range tests {
+		creds := Credentials{ProviderName: "google", ProviderID: "1234", ProviderToken: test.token, Nonce: test.nonce}
+		identity, err := provider.Verify(c, getter, &creds)
+		if test.ok && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: expected error", test.name)
+			continue
+		}
+		if test.ok && (identity.ProviderID != "1234" || identity.Email != "bob@example.com") {
+			t.Errorf("%s: unexpected identity %+v", test.name, identity)
+		}
+	}
+}
+
+func TestOIDCProvider_CachesKeys(t *testing.T) {
+	c := getContext()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	provider := NewGoogleProvider("client-id")
+	provider.Clock = func() time.Time { return now }
+
+	token := signIDToken(t, key, "key1", map[string]interface{}{
+		"iss": "accounts.google.com",
+		"aud": "client-id",
+		"sub": "1234",
+		"exp": now.Add(time.Hour).Unix(),
+	})
+	creds := Credentials{ProviderName: "google", ProviderID: "1234", ProviderToken: token}
+
+	getter := mockURLGetter{body: jwksFixture(key, "key1"), status: http.StatusOK}
+	if _, err = provider.Verify(c, getter, &creds); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failing getter must not be used while the keys are cached
+	failing := mockURLGetter{err: fmt.Errorf("unexpected fetch")}
+	if _, err = provider.Verify(c, failing, &creds); err != nil {
+		t.Errorf("expected cached keys to be used: %v", err)
+	}
+}
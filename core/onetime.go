@@ -0,0 +1,149 @@
+package core
+
+import (
+	"time"
+
+	"github.com/chrisolsen/ae/model"
+	"github.com/chrisolsen/ae/store"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// OneTimeToken purposes
+const (
+	PurposePasswordReset     = "passwordReset"
+	PurposeEmailVerification = "emailVerification"
+	PurposeTwoFactor         = "twoFactor"
+	PurposeRestoreAccount    = "restoreAccount"
+	PurposeExport            = "export"
+)
+
+// OneTimeToken is a single-use, expiring secret linked to an account, such as
+// a password reset token. As with auth tokens, only the secret's digest is saved.
+type OneTimeToken struct {
+	model.Base
+	Purpose string    `json:"purpose" datastore:",noindex"`
+	Expiry  time.Time `json:"expiry" datastore:",noindex"`
+	// optional value the token is bound to, such as the email being verified
+	Subject string `json:"-" datastore:",noindex"`
+	// failed uses, for purposes that allow a limited number of retries
+	Attempts int `json:"-" datastore:",noindex"`
+
+	secret string
+}
+
+// Value returns the value sent to the user; only known when the token is created
+func (t *OneTimeToken) Value() string {
+	if len(t.secret) == 0 {
+		return ""
+	}
+	return tokenValue(t.Key.Parent(), t.secret)
+}
+
+// OneTimeTokenStore .
+type OneTimeTokenStore struct {
+	store.Base
+}
+
+// NewOneTimeTokenStore .
+func NewOneTimeTokenStore() OneTimeTokenStore {
+	s := OneTimeTokenStore{}
+	s.TableName = "oneTimeTokens"
+	return s
+}
+
+// Create creates a token for the purpose and subject that expires after the ttl
+func (s *OneTimeTokenStore) Create(c context.Context, accountKey *datastore.Key, purpose, subject string, ttl time.Duration) (*OneTimeToken, error) {
+	secret, err := newTokenSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	token := OneTimeToken{
+		Purpose: purpose,
+		Subject: subject,
+		Expiry:  time.Now().Add(ttl),
+		secret:  secret,
+	}
+	key := datastore.NewKey(c, s.TableName, tokenDigest(secret), 0, accountKey)
+	token.Key, err = datastore.Put(c, key, &token)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// Get returns the unexpired token with the value and purpose without using it
+func (s *OneTimeTokenStore) Get(c context.Context, value, purpose string) (*OneTimeToken, error) {
+	key, err := s.key(c, value)
+	if err != nil {
+		return nil, err
+	}
+	return s.get(c, key, purpose)
+}
+
+// Consume returns and deletes the unexpired token with the value and purpose,
+// so it can't be used again
+func (s *OneTimeTokenStore) Consume(c context.Context, value, purpose string) (*OneTimeToken, error) {
+	key, err := s.key(c, value)
+	if err != nil {
+		return nil, err
+	}
+
+	var token *OneTimeToken
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		var err error
+		token, err = s.get(tc, key, purpose)
+		if err != nil {
+			return err
+		}
+		return datastore.Delete(tc, key)
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// DeleteAll deletes all of the account's tokens for the purpose
+func (s *OneTimeTokenStore) DeleteAll(c context.Context, accountKey *datastore.Key, purpose string) error {
+	var tokens []*OneTimeToken
+	keys, err := datastore.NewQuery(s.TableName).
+		Ancestor(accountKey).
+		GetAll(c, &tokens)
+	if err != nil {
+		return err
+	}
+
+	var purposeKeys []*datastore.Key
+	for i, t := range tokens {
+		if t.Purpose == purpose {
+			purposeKeys = append(purposeKeys, keys[i])
+		}
+	}
+	return datastore.DeleteMulti(c, purposeKeys)
+}
+
+func (s *OneTimeTokenStore) key(c context.Context, value string) (*datastore.Key, error) {
+	accountKey, secret, err := splitTokenValue(value)
+	if err != nil {
+		return nil, err
+	}
+	return datastore.NewKey(c, s.TableName, tokenDigest(secret), 0, accountKey), nil
+}
+
+func (s *OneTimeTokenStore) get(c context.Context, key *datastore.Key, purpose string) (*OneTimeToken, error) {
+	var token OneTimeToken
+	err := datastore.Get(c, key, &token)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if token.Purpose != purpose || token.Expiry.Before(time.Now()) {
+		return nil, ErrInvalidToken
+	}
+	token.Key = key
+	return &token, nil
+}
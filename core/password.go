@@ -0,0 +1,158 @@
+package core
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// DefaultPasswordResetTTL is how long reset tokens are valid when the service
+// doesn't specify
+const DefaultPasswordResetTTL = time.Hour
+
+// MinPasswordLength is the minimum length of new passwords
+const MinPasswordLength = 8
+
+// ErrWeakPassword is returned when a new password doesn't meet the requirements
+var ErrWeakPassword = NewError(Invalid, "weak_password", fmt.Sprintf("password must be at least %d characters", MinPasswordLength))
+
+// ErrNoPasswordCredentials is returned when resetting the password of an
+// account that only signs in with providers
+var ErrNoPasswordCredentials = NewError(Conflict, "no_password_credentials", "the account has no username / password credentials")
+
+// PasswordService handles recovering forgotten username / password credentials
+type PasswordService struct {
+	Mailer Mailer
+	// ResetURL is the link sent to users; `{token}` is replaced with the reset token
+	ResetURL string
+	ResetTTL time.Duration
+}
+
+// Forgot emails a password reset link to the owner of the username. No error is
+// returned for unknown usernames, or when the link can't be sent to a known
+// one, so the response can't be used to discover accounts.
+func (s *PasswordService) Forgot(c context.Context, username string) error {
+	cstore := NewCredentialStore()
+	var creds []*Credentials
+	keys, err := cstore.GetByUsername(c, username, &creds)
+	if err != nil {
+		return err
+	}
+	if len(keys) != 1 {
+		return nil
+	}
+	accountKey := keys[0].Parent()
+
+	var account Account
+	astore := NewAccountStore()
+	err = astore.Get(c, accountKey, &account)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	to := account.Email
+	if len(to) == 0 && strings.Contains(username, "@") {
+		to = username
+	}
+	if len(to) == 0 {
+		log.Warningf(c, "no email address to send the reset link of %s to", accountKey.Encode())
+		return nil
+	}
+
+	ttl := s.ResetTTL
+	if ttl <= 0 {
+		ttl = DefaultPasswordResetTTL
+	}
+	tstore := NewOneTimeTokenStore()
+	token, err := tstore.Create(c, accountKey, PurposePasswordReset, "", ttl)
+	if err != nil {
+		return fmt.Errorf("creating reset token: %v", err)
+	}
+
+	link := strings.Replace(s.ResetURL, "{token}", url.QueryEscape(token.Value()), -1)
+	err = s.Mailer.Send(c, &Message{
+		To:      to,
+		Subject: "Reset your password",
+		Body:    fmt.Sprintf("Use the following link to reset your password. It expires in %v.\n\n%s\n", ttl, link),
+	})
+	if err != nil {
+		log.Errorf(c, "sending reset link: %v", err)
+	}
+	return nil
+}
+
+// Reset sets the password of the account the reset token belongs to and signs
+// out all of the account's tokens. Each reset token can only be used once.
+// New passwords must be between MinPasswordLength and MaxPasswordLength long.
+func (s *PasswordService) Reset(c context.Context, resetToken, password string) error {
+	if len(password) < MinPasswordLength {
+		return ErrWeakPassword
+	}
+	v := validator{}
+	v.password("password", password)
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	crypt := Crypt{}
+	hash, err := crypt.Encrypt(password)
+	if err != nil {
+		return fmt.Errorf("hashing password: %v", err)
+	}
+
+	tstore := NewOneTimeTokenStore()
+	key, err := tstore.key(c, resetToken)
+	if err != nil {
+		return err
+	}
+	accountKey := key.Parent()
+
+	// the token is only used up once the password is saved; the token and the
+	// credentials are in the account's entity group
+	cstore := NewCredentialStore()
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		_, err := tstore.get(tc, key, PurposePasswordReset)
+		if err != nil {
+			return err
+		}
+
+		var creds []*Credentials
+		keys, err := cstore.GetByParent(tc, accountKey, &creds)
+		if err != nil {
+			return err
+		}
+		var updated []*datastore.Key
+		var updatedCreds []*Credentials
+		for i, cr := range creds {
+			if len(cr.Username) == 0 {
+				continue
+			}
+			cr.PasswordHash = hash
+			updated = append(updated, keys[i])
+			updatedCreds = append(updatedCreds, cr)
+		}
+		if len(updated) == 0 {
+			return ErrNoPasswordCredentials
+		}
+		_, err = datastore.PutMulti(tc, updated, updatedCreds)
+		if err != nil {
+			return fmt.Errorf("updating credentials: %v", err)
+		}
+		return datastore.Delete(tc, key)
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	// any other outstanding reset links are no longer needed
+	if err = tstore.DeleteAll(c, accountKey, PurposePasswordReset); err != nil {
+		return err
+	}
+
+	tokenStore := NewTokenStore()
+	return tokenStore.RevokeAll(c, accountKey)
+}
@@ -0,0 +1,150 @@
+package core
+
+import (
+	"strings"
+	"testing"
+
+	"google.golang.org/appengine/datastore"
+)
+
+func TestPasswordService_Reset(t *testing.T) {
+	c := getContext()
+	mailer := &MemoryMailer{}
+	svc := PasswordService{Mailer: mailer, ResetURL: "https://example.com/reset?token={token}"}
+
+	accountKey, err := datastore.Put(c, datastore.NewIncompleteKey(c, "accounts", nil), &Account{Email: "reset@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cstore := NewCredentialStore()
+	if _, err = cstore.Create(c, &Credentials{Username: "reset-user", Password: "old-password"}, accountKey); err != nil {
+		t.Fatal(err)
+	}
+	tstore := NewTokenStore()
+	authToken, err := tstore.Create(c, accountKey, Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unknown usernames must not error or send mail
+	if err = svc.Forgot(c, "nobody"); err != nil {
+		t.Fatal(err)
+	}
+	if len(mailer.Messages()) != 0 {
+		t.Fatal("expected no email for an unknown username")
+	}
+
+	if err = svc.Forgot(c, "reset-user"); err != nil {
+		t.Fatal(err)
+	}
+	messages := mailer.Messages()
+	if len(messages) != 1 || messages[0].To != "reset@example.com" {
+		t.Fatalf("expected reset email to the account email, got %+v", messages)
+	}
+	resetToken := linkParam(t, messages[0].Body, "token")
+
+	if err = svc.Reset(c, resetToken, "short"); err != ErrWeakPassword {
+		t.Errorf("expected weak password error, got %v", err)
+	}
+	long := strings.Repeat("a", MaxPasswordLength+1)
+	if fields := FieldsOf(svc.Reset(c, resetToken, long)); len(fields) != 1 || fields[0].Code != "too_long" {
+		t.Errorf("expected long password to be invalid, got %v", fields)
+	}
+	if err = svc.Reset(c, resetToken, "new-password"); err != nil {
+		t.Fatal(err)
+	}
+
+	// reset tokens are single use
+	if err = svc.Reset(c, resetToken, "other-password"); err != ErrInvalidToken {
+		t.Errorf("expected used reset token to be rejected, got %v", err)
+	}
+
+	var creds []*Credentials
+	if _, err = cstore.GetByParent(c, accountKey, &creds); err != nil {
+		t.Fatal(err)
+	}
+	crypt := Crypt{}
+	if err = crypt.Validate(creds[0].PasswordHash, "new-password"); err != nil {
+		t.Errorf("expected new password to be saved: %v", err)
+	}
+
+	var token Token
+	if err = datastore.Get(c, authToken.Key, &token); err != datastore.ErrNoSuchEntity {
+		t.Errorf("expected existing tokens to be revoked, got %v", err)
+	}
+}
+
+func TestPasswordService_ForgotWithoutEmail(t *testing.T) {
+	c := getContext()
+	mailer := &MemoryMailer{}
+	svc := PasswordService{Mailer: mailer, ResetURL: "https://example.com/reset?token={token}"}
+
+	accountKey, err := datastore.Put(c, datastore.NewIncompleteKey(c, "accounts", nil), &Account{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cstore := NewCredentialStore()
+	if _, err = cstore.Create(c, &Credentials{Username: "no-email-user", Password: "foobario"}, accountKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// known usernames must respond as unknown ones do
+	if err = svc.Forgot(c, "no-email-user"); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	if len(mailer.Messages()) != 0 {
+		t.Error("expected no email without an address")
+	}
+}
+
+func TestPasswordService_ResetWithoutPassword(t *testing.T) {
+	c := getContext()
+	svc := PasswordService{Mailer: &MemoryMailer{}}
+
+	accountKey, err := datastore.Put(c, datastore.NewIncompleteKey(c, "accounts", nil), &Account{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cstore := NewCredentialStore()
+	if _, err = cstore.Create(c, &Credentials{ProviderID: "reset-provider", ProviderName: "google"}, accountKey); err != nil {
+		t.Fatal(err)
+	}
+	tstore := NewOneTimeTokenStore()
+	token, err := tstore.Create(c, accountKey, PurposePasswordReset, "", DefaultPasswordResetTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = svc.Reset(c, token.Value(), "new-password"); err != ErrNoPasswordCredentials {
+		t.Errorf("expected no password credentials, got %v", err)
+	}
+	if _, err = tstore.Get(c, token.Value(), PurposePasswordReset); err != nil {
+		t.Errorf("expected reset token to remain unused: %v", err)
+	}
+}
+
+func TestOneTimeTokenStore_Purpose(t *testing.T) {
+	c := getContext()
+	store := NewOneTimeTokenStore()
+	accountKey := datastore.NewKey(c, "accounts", "onetime", 0, nil)
+
+	token, err := store.Create(c, accountKey, PurposePasswordReset, "", DefaultPasswordResetTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = store.Consume(c, token.Value(), "other"); err != ErrInvalidToken {
+		t.Errorf("expected token to be rejected for another purpose, got %v", err)
+	}
+	if _, err = store.Get(c, token.Value(), PurposePasswordReset); err != nil {
+		t.Errorf("expected token to remain after failed consume: %v", err)
+	}
+
+	expired, err := store.Create(c, accountKey, PurposePasswordReset, "", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Consume(c, expired.Value(), PurposePasswordReset); err != ErrInvalidToken {
+		t.Errorf("expected expired token to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,36 @@
+package core
+
+import "golang.org/x/net/context"
+
+// Identity is the normalized user details returned by an auth provider
+type Identity struct {
+	ProviderID string `json:"providerId"`
+	Email      string `json:"email"`
+	Name       string `json:"name"`
+	Picture    string `json:"picture"`
+}
+
+// AuthProvider verifies the provider token within the credentials with an
+// external identity provider
+type AuthProvider interface {
+	// Name is the value matched against Credentials.ProviderName
+	Name() string
+	// Verify validates the credentials' provider token and returns the
+	// identity it belongs to. Any external calls must be made with the getter.
+	Verify(c context.Context, getter URLGetter, creds *Credentials) (*Identity, error)
+}
+
+// AuthProviders is a registry of the enabled auth providers keyed by name
+type AuthProviders map[string]AuthProvider
+
+// Register adds the provider to the registry, replacing any existing provider
+// of the same name
+func (p AuthProviders) Register(provider AuthProvider) {
+	p[provider.Name()] = provider
+}
+
+// Get returns the provider registered under the name
+func (p AuthProviders) Get(name string) (AuthProvider, bool) {
+	provider, ok := p[name]
+	return provider, ok
+}
@@ -0,0 +1,182 @@
+package core
+
+import (
+	"strings"
+	"time"
+
+	"github.com/chrisolsen/ae/store"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// Reservation kinds
+const (
+	ReserveUsername = "username"
+	ReserveEmail    = "email"
+)
+
+// Reservation errors
+var (
+	ErrUsernameTaken = NewError(Conflict, "username_taken", "username is already taken")
+	ErrEmailTaken    = NewError(Conflict, "email_taken", "email is already in use")
+	ErrReserved      = NewError(Conflict, "reserved", "value is already in use")
+)
+
+// Reservation claims a unique value, such as a username, for an account. The
+// normalized value is the key name, so claims are checked with a get that can
+// run within the transaction that saves the value.
+type Reservation struct {
+	AccountKey *datastore.Key `json:"-"`
+	Created    time.Time      `json:"-" datastore:",noindex"`
+}
+
+// ReservationStore .
+type ReservationStore struct {
+	store.Base
+}
+
+// NewReservationStore .
+func NewReservationStore() ReservationStore {
+	s := ReservationStore{}
+	s.TableName = "reservations"
+	return s
+}
+
+// Key returns the reservation key of the value
+func (s *ReservationStore) Key(c context.Context, kind, value string) *datastore.Key {
+	return datastore.NewKey(c, s.TableName, kind+":"+normalizeReserved(value), 0, nil)
+}
+
+// Reserve claims the value for the account. Values already claimed by another
+// account return the kind's taken error. Call within a cross group transaction
+// along with the entity that holds the value.
+func (s *ReservationStore) Reserve(c context.Context, accountKey *datastore.Key, kind, value string) error {
+	key := s.Key(c, kind, value)
+
+	var r Reservation
+	err := datastore.Get(c, key, &r)
+	if err == nil {
+		if r.AccountKey.Equal(accountKey) {
+			return nil
+		}
+		return reservedError(kind)
+	}
+	if err != datastore.ErrNoSuchEntity {
+		return err
+	}
+
+	_, err = datastore.Put(c, key, &Reservation{AccountKey: accountKey, Created: time.Now()})
+	return err
+}
+
+// Release frees the value if it is claimed by the account
+func (s *ReservationStore) Release(c context.Context, accountKey *datastore.Key, kind, value string) error {
+	key := s.Key(c, kind, value)
+
+	var r Reservation
+	err := datastore.Get(c, key, &r)
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !r.AccountKey.Equal(accountKey) {
+		return nil
+	}
+	return datastore.Delete(c, key)
+}
+
+// ReleaseAll frees the account's email and usernames. They are read from the
+// account and its credentials rather than queried, since the query's results
+// are only eventually consistent. It can't be run within a transaction.
+func (s *ReservationStore) ReleaseAll(c context.Context, accountKey *datastore.Key) error {
+	values, err := s.accountValues(c, accountKey)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range values {
+		err = datastore.RunInTransaction(c, func(tc context.Context) error {
+			return s.Release(tc, accountKey, v.kind, v.value)
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReserveAll claims the account's email and usernames for accounts created
+// before they were reserved. Values already claimed by another account are
+// logged and skipped. It can't be run within a transaction.
+func (s *ReservationStore) ReserveAll(c context.Context, accountKey *datastore.Key) error {
+	values, err := s.accountValues(c, accountKey)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range values {
+		err = datastore.RunInTransaction(c, func(tc context.Context) error {
+			return s.Reserve(tc, accountKey, v.kind, v.value)
+		}, nil)
+		if KindOf(err) == Conflict {
+			log.Warningf(c, "%s %s of %s is claimed by another account", v.kind, v.value, accountKey.Encode())
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reservedValue is a value of an account that is reserved
+type reservedValue struct {
+	kind  string
+	value string
+}
+
+// accountValues returns the account's values that are reserved: its email
+// and the usernames of its credentials
+func (s *ReservationStore) accountValues(c context.Context, accountKey *datastore.Key) ([]reservedValue, error) {
+	var values []reservedValue
+
+	var account Account
+	err := datastore.Get(c, accountKey, &account)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	if len(account.Email) > 0 {
+		values = append(values, reservedValue{ReserveEmail, account.Email})
+	}
+
+	cStore := NewCredentialStore()
+	var creds []*Credentials
+	_, err = cStore.GetByParent(c, accountKey, &creds)
+	if err != nil {
+		return nil, err
+	}
+	for _, cr := range creds {
+		if len(cr.ProviderID) == 0 && len(cr.Username) > 0 {
+			values = append(values, reservedValue{ReserveUsername, cr.Username})
+		}
+	}
+	return values, nil
+}
+
+func normalizeReserved(value string) string {
+	return strings.ToLower(strings.TrimSpace(value))
+}
+
+func reservedError(kind string) error {
+	switch kind {
+	case ReserveUsername:
+		return ErrUsernameTaken
+	case ReserveEmail:
+		return ErrEmailTaken
+	default:
+		return ErrReserved
+	}
+}
@@ -0,0 +1,93 @@
+package core
+
+import (
+	"testing"
+
+	"google.golang.org/appengine/datastore"
+)
+
+func TestAccountStore_CreateUnique(t *testing.T) {
+	c := getContext()
+	store := NewAccountStore()
+
+	firstKey, err := store.Create(c, &Credentials{Username: "unique", Password: "foobario"}, &Account{Email: "unique@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.Create(c, &Credentials{Username: "Unique ", Password: "foobario"}, &Account{Email: "other@example.com"})
+	if err != ErrUsernameTaken {
+		t.Errorf("expected username to be taken, got %v", err)
+	}
+	_, err = store.Create(c, &Credentials{Username: "other", Password: "foobario"}, &Account{Email: "UNIQUE@example.com"})
+	if err != ErrEmailTaken {
+		t.Errorf("expected email to be taken, got %v", err)
+	}
+
+	// failed signups must not hold on to their values
+	if _, err = store.Create(c, &Credentials{Username: "other", Password: "foobario"}, &Account{Email: "other@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// emails are released when changed
+	if err = store.UpdateEmail(c, firstKey, "changed@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	var account Account
+	if err = datastore.Get(c, firstKey, &account); err != nil {
+		t.Fatal(err)
+	}
+	if account.Email != "changed@example.com" {
+		t.Errorf("expected email to be updated, got %s", account.Email)
+	}
+	if _, err = store.Create(c, &Credentials{Username: "third", Password: "foobario"}, &Account{Email: "unique@example.com"}); err != nil {
+		t.Errorf("expected previous email to be released: %v", err)
+	}
+	if err = store.UpdateEmail(c, firstKey, "other@example.com"); err != ErrEmailTaken {
+		t.Errorf("expected email to be taken, got %v", err)
+	}
+}
+
+func TestReservationStore_Backfill(t *testing.T) {
+	c := getContext()
+	store := NewAccountStore()
+
+	// created before emails and usernames were reserved
+	legacy := struct{ Email string }{"legacy@example.com"}
+	legacyKey, err := datastore.Put(c, datastore.NewIncompleteKey(c, accountsTable, nil), &legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credsKey := datastore.NewIncompleteKey(c, "credentials", legacyKey)
+	if _, err = datastore.Put(c, credsKey, &Credentials{Username: "legacy"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for cursor := ""; ; {
+		cursor, err = store.Backfill(c, cursor, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cursor) == 0 {
+			break
+		}
+	}
+
+	_, err = store.Create(c, &Credentials{Username: "notlegacy", Password: "foobario"}, &Account{Email: "legacy@example.com"})
+	if err != ErrEmailTaken {
+		t.Errorf("expected backfilled email to be taken, got %v", err)
+	}
+	_, err = store.Create(c, &Credentials{Username: "legacy", Password: "foobario"}, &Account{})
+	if err != ErrUsernameTaken {
+		t.Errorf("expected backfilled username to be taken, got %v", err)
+	}
+
+	// released without querying the reservations
+	if err = store.Delete(c, legacyKey); err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Create(c, &Credentials{Username: "legacy", Password: "foobario"}, &Account{Email: "legacy@example.com"})
+	if err != nil {
+		t.Errorf("expected deleted account's values to be released, got %v", err)
+	}
+}
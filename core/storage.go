@@ -0,0 +1,196 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/file"
+	"google.golang.org/appengine/urlfetch"
+)
+
+// ErrObjectNotFound is returned when reading objects that don't exist
+var ErrObjectNotFound = NewError(NotFound, "object_not_found", "stored object not found")
+
+// Storage reads and writes named objects, such as attachments and exports
+type Storage interface {
+	Read(c context.Context, name string) ([]byte, error)
+	Write(c context.Context, name, contentType string, data []byte) error
+	// Delete ignores objects that don't exist
+	Delete(c context.Context, name string) error
+}
+
+// storageScope is the OAuth scope GCSStorage requests access tokens for
+const storageScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// GCSStorage stores objects in Cloud Storage through its XML API, using only
+// the App Engine packages. Objects are saved to the app's default bucket unless
+// the bucket is set; the dev server's default bucket is set with its
+// --default_gcs_bucket_name flag and its objects are kept by the dev server's
+// Cloud Storage emulation.
+type GCSStorage struct {
+	Bucket string
+}
+
+// Read .
+func (s GCSStorage) Read(c context.Context, name string) ([]byte, error) {
+	objectURL, err := s.objectURL(c, name)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.do(c, http.MethodGet, objectURL, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return ioutil.ReadAll(res.Body)
+}
+
+// Write uploads the object with a resumable upload, which both Cloud Storage
+// and the dev server's emulation accept, completed in a single request
+func (s GCSStorage) Write(c context.Context, name, contentType string, data []byte) error {
+	objectURL, err := s.objectURL(c, name)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(c, http.MethodPost, objectURL, http.Header{
+		"Content-Type":     {contentType},
+		"X-Goog-Resumable": {"start"},
+	}, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	// the location may be relative to the object
+	base, err := url.Parse(objectURL)
+	if err != nil {
+		return err
+	}
+	location, err := base.Parse(res.Header.Get("Location"))
+	if err != nil || len(res.Header.Get("Location")) == 0 {
+		return fmt.Errorf("storage: starting upload of %s: missing upload location", name)
+	}
+	contentRange := "bytes */0"
+	if len(data) > 0 {
+		contentRange = fmt.Sprintf("bytes 0-%d/%d", len(data)-1, len(data))
+	}
+	res, err = s.do(c, http.MethodPut, location.String(), http.Header{"Content-Range": {contentRange}}, data)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Delete .
+func (s GCSStorage) Delete(c context.Context, name string) error {
+	objectURL, err := s.objectURL(c, name)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(c, http.MethodDelete, objectURL, nil, nil)
+	if err == ErrObjectNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// do sends the authorized request, returning ErrObjectNotFound for missing
+// objects and an error for any other unsuccessful status
+func (s GCSStorage) do(c context.Context, method, rawURL string, header http.Header, data []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, rawURL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	// the dev server's emulation doesn't check the token
+	if !appengine.IsDevAppServer() {
+		token, _, err := appengine.AccessToken(c, storageScope)
+		if err != nil {
+			return nil, fmt.Errorf("getting storage access token: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := urlfetch.Client(c).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, ErrObjectNotFound
+	}
+	if res.StatusCode >= http.StatusMultipleChoices {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, fmt.Errorf("storage: %s %s: %d %s", method, req.URL.Path, res.StatusCode, body)
+	}
+	return res, nil
+}
+
+// objectURL returns the object's XML API URL; the dev server serves its
+// emulation under /_ah/gcs
+func (s GCSStorage) objectURL(c context.Context, name string) (string, error) {
+	bucket := s.Bucket
+	if len(bucket) == 0 {
+		var err error
+		bucket, err = file.DefaultBucketName(c)
+		if err != nil {
+			return "", fmt.Errorf("getting default bucket: %v", err)
+		}
+	}
+
+	base := "https://storage.googleapis.com"
+	if appengine.IsDevAppServer() {
+		base = "http://" + appengine.DefaultVersionHostname(c) + "/_ah/gcs"
+	}
+	path := &url.URL{Path: "/" + bucket + "/" + name}
+	return base + path.EscapedPath(), nil
+}
+
+// MemoryStorage keeps objects in memory instead of storing them
+type MemoryStorage struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+// Read .
+func (s *MemoryStorage) Read(c context.Context, name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[name]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	return append([]byte(nil), data...), nil
+}
+
+// Write .
+func (s *MemoryStorage) Write(c context.Context, name, contentType string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.objects == nil {
+		s.objects = map[string][]byte{}
+	}
+	s.objects[name] = append([]byte(nil), data...)
+	return nil
+}
+
+// Delete .
+func (s *MemoryStorage) Delete(c context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, name)
+	return nil
+}
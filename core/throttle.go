@@ -0,0 +1,238 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+const loginAttemptsTable = "loginAttempts"
+
+// Default LoginThrottle thresholds
+const (
+	DefaultFreeAttempts    = 5
+	DefaultBaseDelay       = time.Second
+	DefaultMaxDelay        = time.Minute * 15
+	DefaultLockoutAttempts = 20
+	DefaultLockoutDuration = time.Hour
+	DefaultAttemptWindow   = time.Hour * 24
+)
+
+// ThrottledError is returned while further attempts are blocked
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("too many failed attempts; retry after %v", e.RetryAfter)
+}
+
+// loginAttempts is the failed attempt record for a username, IP, etc.
+type loginAttempts struct {
+	Failures    int       `datastore:",noindex"`
+	LastFailure time.Time `datastore:",noindex"`
+	RetryAt     time.Time `datastore:",noindex"`
+}
+
+// LoginThrottle limits failed authentication attempts per key, such as a
+// username or client IP. Once the free attempts are used up each further failure
+// doubles the delay before the next attempt is allowed, up to the max delay,
+// and the key is locked out for the lockout duration after too many failures.
+// Counts are saved in the datastore and cached in memcache, where the checks
+// are made. Zero valued thresholds use the defaults and a nil throttle allows
+// all attempts.
+type LoginThrottle struct {
+	FreeAttempts    int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutAttempts int
+	LockoutDuration time.Duration
+	// Window is how long after the last failure the count is forgotten
+	Window time.Duration
+	Clock  Clock
+}
+
+// Check returns a *ThrottledError if any of the keys are blocked
+func (t *LoginThrottle) Check(c context.Context, keys ...string) error {
+	if t == nil {
+		return nil
+	}
+
+	now := t.Clock.Now()
+	var retryAfter time.Duration
+	for _, key := range keys {
+		attempts, err := t.get(c, key)
+		if err != nil {
+			return err
+		}
+		if wait := attempts.RetryAt.Sub(now); wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+
+	if retryAfter > 0 {
+		return &ThrottledError{RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// Fail records a failed attempt against each of the keys
+func (t *LoginThrottle) Fail(c context.Context, keys ...string) error {
+	if t == nil {
+		return nil
+	}
+
+	now := t.Clock.Now()
+	for _, key := range keys {
+		var attempts loginAttempts
+		dsKey := t.key(c, key)
+		err := datastore.RunInTransaction(c, func(tc context.Context) error {
+			attempts = loginAttempts{}
+			err := datastore.Get(tc, dsKey, &attempts)
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			if now.Sub(attempts.LastFailure) > t.window() {
+				attempts = loginAttempts{}
+			}
+
+			attempts.Failures++
+			attempts.LastFailure = now
+			attempts.RetryAt = now.Add(t.delay(attempts.Failures))
+			_, err = datastore.Put(tc, dsKey, &attempts)
+			return err
+		}, nil)
+		if err != nil {
+			return fmt.Errorf("recording failed attempt: %v", err)
+		}
+
+		t.cache(c, key, &attempts)
+	}
+	return nil
+}
+
+// Reset clears the failed attempts of the keys
+func (t *LoginThrottle) Reset(c context.Context, keys ...string) error {
+	if t == nil || len(keys) == 0 {
+		return nil
+	}
+
+	var dsKeys []*datastore.Key
+	var cacheKeys []string
+	for _, key := range keys {
+		dsKeys = append(dsKeys, t.key(c, key))
+		cacheKeys = append(cacheKeys, loginAttemptsCacheKey(key))
+	}
+
+	err := deleteCache(c, cacheKeys)
+	if err != nil {
+		return err
+	}
+	return datastore.DeleteMulti(c, dsKeys)
+}
+
+// delay returns how long to block attempts after the number of failures
+func (t *LoginThrottle) delay(failures int) time.Duration {
+	lockoutAttempts := t.LockoutAttempts
+	if lockoutAttempts <= 0 {
+		lockoutAttempts = DefaultLockoutAttempts
+	}
+	if failures >= lockoutAttempts {
+		return durationOr(t.LockoutDuration, DefaultLockoutDuration)
+	}
+
+	freeAttempts := t.FreeAttempts
+	if freeAttempts <= 0 {
+		freeAttempts = DefaultFreeAttempts
+	}
+	if failures <= freeAttempts {
+		return 0
+	}
+
+	maxDelay := durationOr(t.MaxDelay, DefaultMaxDelay)
+	delay := durationOr(t.BaseDelay, DefaultBaseDelay)
+	for i := freeAttempts + 1; i < failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+func (t *LoginThrottle) window() time.Duration {
+	return durationOr(t.Window, DefaultAttemptWindow)
+}
+
+// get returns the cached attempts, falling back to the datastore
+func (t *LoginThrottle) get(c context.Context, key string) (*loginAttempts, error) {
+	var attempts loginAttempts
+	_, err := memcache.JSON.Get(c, loginAttemptsCacheKey(key), &attempts)
+	if err == nil {
+		return &attempts, nil
+	}
+	if err != memcache.ErrCacheMiss {
+		log.Warningf(c, "getting cached login attempts: %v", err)
+	}
+
+	err = datastore.Get(c, t.key(c, key), &attempts)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	t.cache(c, key, &attempts)
+	return &attempts, nil
+}
+
+// cache saves the attempts to memcache; failures are only logged since the
+// datastore remains the source of truth
+func (t *LoginThrottle) cache(c context.Context, key string, attempts *loginAttempts) {
+	err := memcache.JSON.Set(c, &memcache.Item{
+		Key:        loginAttemptsCacheKey(key),
+		Object:     attempts,
+		Expiration: t.window(),
+	})
+	if err != nil {
+		log.Warningf(c, "caching login attempts: %v", err)
+	}
+}
+
+func (t *LoginThrottle) key(c context.Context, key string) *datastore.Key {
+	return datastore.NewKey(c, loginAttemptsTable, key, 0, nil)
+}
+
+func loginAttemptsCacheKey(key string) string {
+	return "loginAttempts:" + key
+}
+
+// UsernameThrottleKey returns the throttle key for the username
+func UsernameThrottleKey(username string) string {
+	return "username:" + strings.ToLower(strings.TrimSpace(username))
+}
+
+// ProviderThrottleKey returns the throttle key for the provider identity
+func ProviderThrottleKey(providerName, providerID string) string {
+	return "provider:" + providerName + ":" + providerID
+}
+
+// AccountThrottleKey returns the throttle key for attempts against the account,
+// such as second factor codes
+func AccountThrottleKey(accountKey *datastore.Key) string {
+	return "account:" + accountKey.Encode()
+}
+
+// IPThrottleKey returns the throttle key for the client IP
+func IPThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+func durationOr(d, fallback time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return fallback
+}
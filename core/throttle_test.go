@@ -0,0 +1,121 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestLoginThrottle_Backoff(t *testing.T) {
+	c := getContext()
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	throttle := LoginThrottle{
+		FreeAttempts:    2,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Second * 4,
+		LockoutAttempts: 7,
+		LockoutDuration: time.Hour,
+		Clock:           func() time.Time { return now },
+	}
+	key := UsernameThrottleKey("backoff")
+
+	retryAfter := func() time.Duration {
+		err := throttle.Check(c, key)
+		if err == nil {
+			return 0
+		}
+		throttled, ok := err.(*ThrottledError)
+		if !ok {
+			t.Fatal(err)
+		}
+		return throttled.RetryAfter
+	}
+
+	// the delay doubles after the free attempts until the max delay, then the
+	// key is locked out
+	expected := []time.Duration{0, 0, time.Second, time.Second * 2, time.Second * 4, time.Second * 4, time.Hour}
+	for i, delay := range expected {
+		if err := throttle.Fail(c, key); err != nil {
+			t.Fatal(err)
+		}
+		if d := retryAfter(); d != delay {
+			t.Fatalf("failure %d: expected retry after %v, got %v", i+1, delay, d)
+		}
+		now = now.Add(delay)
+	}
+	if d := retryAfter(); d != 0 {
+		t.Errorf("expected lockout to end, got retry after %v", d)
+	}
+
+	// failures are forgotten after the window
+	now = now.Add(DefaultAttemptWindow + time.Second)
+	throttle.Fail(c, key)
+	if d := retryAfter(); d != 0 {
+		t.Errorf("expected failures outside the window to be forgotten, got retry after %v", d)
+	}
+}
+
+func TestLoginThrottle_DatastoreFallback(t *testing.T) {
+	c := getContext()
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	throttle := LoginThrottle{FreeAttempts: 1, Clock: func() time.Time { return now }}
+	key := IPThrottleKey("10.0.0.1")
+
+	throttle.Fail(c, key)
+	throttle.Fail(c, key)
+	memcache.Delete(c, loginAttemptsCacheKey(key))
+
+	if _, ok := throttle.Check(c, key).(*ThrottledError); !ok {
+		t.Error("expected attempts to be loaded from the datastore")
+	}
+
+	if err := throttle.Reset(c, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := throttle.Check(c, key); err != nil {
+		t.Errorf("expected reset to clear attempts, got %v", err)
+	}
+}
+
+func TestAuthService_Throttle(t *testing.T) {
+	c := getContext()
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	throttle := &LoginThrottle{FreeAttempts: 2, Clock: func() time.Time { return now }}
+	svc := AuthService{Throttle: throttle, Device: Device{IP: "10.0.0.2"}}
+
+	accountKey, err := datastore.Put(c, datastore.NewKey(c, "accounts", "throttled", 0, nil), &Account{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cstore := NewCredentialStore()
+	if _, err := cstore.Create(c, &Credentials{Username: "throttled", Password: "foobario"}, accountKey); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := svc.Authenticate(c, &Credentials{Username: "throttled", Password: "wrong"})
+		if err != ErrInvalidCredentials {
+			t.Fatalf("expected invalid credentials, got %v", err)
+		}
+	}
+
+	// once the free attempts are used up even valid credentials are blocked
+	if _, err := svc.Authenticate(c, &Credentials{Username: "throttled", Password: "wrong"}); err != ErrInvalidCredentials {
+		t.Fatalf("expected invalid credentials, got %v", err)
+	}
+	if _, err := svc.Authenticate(c, &Credentials{Username: "throttled", Password: "foobario"}); err == nil {
+		t.Fatal("expected attempt to be throttled")
+	} else if _, ok := err.(*ThrottledError); !ok {
+		t.Fatalf("expected throttled error, got %v", err)
+	}
+
+	now = now.Add(DefaultBaseDelay)
+	if _, err := svc.Authenticate(c, &Credentials{Username: "throttled", Password: "foobario"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := throttle.Check(c, UsernameThrottleKey("throttled")); err != nil {
+		t.Errorf("expected username failures to be reset, got %v", err)
+	}
+}
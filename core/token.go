@@ -1,19 +1,63 @@
 package core
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/chrisolsen/ae/model"
 	"github.com/chrisolsen/ae/store"
-
 	"golang.org/x/net/context"
+	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
 )
 
-// Token .
+const tokensTable = "tokens"
+
+// maximum saved length of a token's user agent
+const maxUserAgentLength = 256
+
+// TokenRotationGrace is how long a token remains valid once it has been rotated
+var TokenRotationGrace = time.Minute * 5
+
+// ErrInvalidToken is returned when a token value is malformed
+var ErrInvalidToken = NewError(Invalid, "invalid_token", "invalid or expired token")
+
+// Token is a random secret linked to an account. Only the SHA-256 digest of the
+// secret is saved, as the token's key name, so the token's value can't be
+// recovered from the datastore. A rotated token's successor secret is only
+// cached for the rotation grace period, so parallel requests receive it.
+//
+// Tokens created before secrets were hashed have numeric ids and their value is
+// the encoded datastore key. These legacy tokens are replaced on their next use.
 type Token struct {
 	model.Base
 	Expiry time.Time `json:"expiry" datastore:",noindex"`
+
+	// device the token was issued to
+	IssuedAt   time.Time `json:"issuedAt" datastore:",noindex"`
+	LastUsedAt time.Time `json:"lastUsedAt" datastore:",noindex"`
+	UserAgent  string    `json:"userAgent" datastore:",noindex"`
+	IP         string    `json:"ip" datastore:",noindex"`
+
+	// token that replaced this one on rotation
+	Successor *datastore.Key `json:"-" datastore:",noindex"`
+
+	// only known when the token is created or rotated
+	secret string
+}
+
+// Device describes the client requesting a token
+type Device struct {
+	UserAgent string
+	IP        string
 }
 
 // Load .
@@ -32,9 +76,117 @@ func (t *Token) Save() ([]datastore.Property, error) {
 	return datastore.SaveStruct(t)
 }
 
-// Value returns the datastore key's string value
+// MarshalJSON only exposes the token's value and expiry to clients, rather
+// than its datastore key and device details, so tokens are returned as
+//
+// 	{
+// 		"token": "<encoded account key>.<secret>",
+// 		"expiry": "2017-01-01T00:00:00Z"
+// 	}
+//
+// The token value is blank for tokens loaded from the datastore.
+func (t *Token) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Token  string    `json:"token"`
+		Expiry time.Time `json:"expiry"`
+	}{t.Value(), t.Expiry})
+}
+
+// Value returns the value clients authenticate with. Tokens loaded from the
+// datastore have no value since the secret isn't saved.
 func (t *Token) Value() string {
-	return t.Key.Encode()
+	if t.IsLegacy() {
+		return t.Key.Encode()
+	}
+	if len(t.secret) == 0 {
+		return ""
+	}
+	return tokenValue(t.Key.Parent(), t.secret)
+}
+
+// IsLegacy indicates if the token's value is its datastore key
+func (t *Token) IsLegacy() bool {
+	return isLegacyTokenKey(t.Key)
+}
+
+// ID identifies the token within the account's tokens without exposing its value
+func (t *Token) ID() string {
+	if t.IsLegacy() {
+		return strconv.FormatInt(t.Key.IntID(), 10)
+	}
+	return t.Key.StringID()
+}
+
+// TokenCacheKey returns the memcache key the token's details are cached under
+func TokenCacheKey(tokenKey *datastore.Key) string {
+	if isLegacyTokenKey(tokenKey) {
+		return tokenKey.Encode()
+	}
+	return tokensTable + ":" + tokenKey.StringID()
+}
+
+// ParseToken returns the key of the token with the value along with its secret
+func ParseToken(c context.Context, value string) (*datastore.Key, string, error) {
+	if !strings.Contains(value, ".") {
+		key, err := datastore.DecodeKey(value)
+		if err != nil || key.Kind() != tokensTable || !isLegacyTokenKey(key) {
+			return nil, "", ErrInvalidToken
+		}
+		return key, value, nil
+	}
+
+	accountKey, secret, err := splitTokenValue(value)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return datastore.NewKey(c, tokensTable, tokenDigest(secret), 0, accountKey), secret, nil
+}
+
+// splitTokenValue returns the account key and secret within a token value
+func splitTokenValue(value string) (*datastore.Key, string, error) {
+	i := strings.Index(value, ".")
+	if i < 0 {
+		return nil, "", ErrInvalidToken
+	}
+	accountKey, err := datastore.DecodeKey(value[:i])
+	if err != nil {
+		return nil, "", ErrInvalidToken
+	}
+	secret := value[i+1:]
+	if len(secret) == 0 {
+		return nil, "", ErrInvalidToken
+	}
+	return accountKey, secret, nil
+}
+
+// successorCacheKey returns the memcache key the secret of the token's
+// successor is cached under during the rotation grace period
+func successorCacheKey(tokenKey *datastore.Key) string {
+	return TokenCacheKey(tokenKey) + ":successor"
+}
+
+func isLegacyTokenKey(key *datastore.Key) bool {
+	return len(key.StringID()) == 0
+}
+
+// tokenValue joins the account key and secret; the account key allows the
+// token's key to be built from its value
+func tokenValue(accountKey *datastore.Key, secret string) string {
+	return accountKey.Encode() + "." + secret
+}
+
+func tokenDigest(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func newTokenSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
 // TokenStore .
@@ -45,18 +197,272 @@ type TokenStore struct {
 // NewTokenStore .
 func NewTokenStore() TokenStore {
 	s := TokenStore{}
-	s.TableName = "tokens"
+	s.TableName = tokensTable
 	return s
 }
 
 // Create overrides base method since token creation doesn't need any data
-// other than the account key
-func (s *TokenStore) Create(c context.Context, accountKey *datastore.Key) (*Token, error) {
-	var token Token
-	key, err := s.Base.Create(c, &token, accountKey)
+// other than the account key and requesting device
+func (s *TokenStore) Create(c context.Context, accountKey *datastore.Key, device Device) (*Token, error) {
+	secret, err := newTokenSecret()
+	if err != nil {
+		return nil, err
+	}
+	return s.create(c, accountKey, secret, device)
+}
+
+func (s *TokenStore) create(c context.Context, accountKey *datastore.Key, secret string, device Device) (*Token, error) {
+	now := time.Now()
+	token := Token{
+		IssuedAt:   now,
+		LastUsedAt: now,
+		UserAgent:  device.UserAgent,
+		IP:         device.IP,
+		secret:     secret,
+	}
+	if len(token.UserAgent) > maxUserAgentLength {
+		token.UserAgent = token.UserAgent[:maxUserAgentLength]
+	}
+
+	key := datastore.NewKey(c, s.TableName, tokenDigest(secret), 0, accountKey)
+	key, err := datastore.Put(c, key, &token)
 	if err != nil {
 		return nil, err
 	}
 	token.Key = key
 	return &token, nil
 }
+
+// KeyFromID returns the key of the account's token with the ID
+func (s *TokenStore) KeyFromID(c context.Context, accountKey *datastore.Key, id string) (*datastore.Key, error) {
+	if len(id) == 0 {
+		return nil, ErrInvalidToken
+	}
+	if intID, err := strconv.ParseInt(id, 10, 64); err == nil {
+		return datastore.NewKey(c, s.TableName, "", intID, accountKey), nil
+	}
+	return datastore.NewKey(c, s.TableName, id, 0, accountKey), nil
+}
+
+// GetByAccount returns all of the account's tokens
+func (s *TokenStore) GetByAccount(c context.Context, accountKey *datastore.Key) ([]*Token, error) {
+	var tokens []*Token
+	keys, err := datastore.NewQuery(s.TableName).
+		Ancestor(accountKey).
+		GetAll(c, &tokens)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		tokens[i].Key = key
+	}
+	return tokens, nil
+}
+
+// Touch records the time the token was last used. Tokens that have been
+// revoked are not recreated.
+func (s *TokenStore) Touch(c context.Context, tokenKey *datastore.Key, usedAt time.Time) error {
+	return datastore.RunInTransaction(c, func(tc context.Context) error {
+		var token Token
+		err := datastore.Get(tc, tokenKey, &token)
+		if err != nil {
+			return err
+		}
+		token.LastUsedAt = usedAt
+		_, err = datastore.Put(tc, tokenKey, &token)
+		return err
+	}, nil)
+}
+
+// Rotate replaces the token with a new one, with a random secret, and shortens
+// the old token's expiry to the rotation grace period. A token only ever has
+// one successor, so repeated rotations return the same successor; its value is
+// only known for the grace period, after which it is blank.
+func (s *TokenStore) Rotate(c context.Context, tokenKey *datastore.Key, device Device) (rotated *Token, successor *Token, err error) {
+	nextSecret, err := newTokenSecret()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var created bool
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		created = false
+		var token Token
+		err := datastore.Get(tc, tokenKey, &token)
+		if err != nil {
+			return err
+		}
+		token.Key = tokenKey
+		rotated = &token
+
+		if token.Successor != nil {
+			var next Token
+			err = datastore.Get(tc, token.Successor, &next)
+			if err != nil {
+				return err
+			}
+			next.Key = token.Successor
+			successor = &next
+			return nil
+		}
+
+		successor, err = s.create(tc, tokenKey.Parent(), nextSecret, device)
+		if err != nil {
+			return err
+		}
+		created = true
+
+		token.Successor = successor.Key
+		graceExpiry := time.Now().Add(TokenRotationGrace)
+		if token.Expiry.After(graceExpiry) {
+			token.Expiry = graceExpiry
+		}
+		_, err = datastore.Put(tc, tokenKey, &token)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !created {
+		successor.secret = s.awaitSuccessorSecret(c, tokenKey, successor)
+		return rotated, successor, nil
+	}
+
+	// cached once committed, and only by the first writer, so the cached secret
+	// always belongs to the saved successor
+	err = memcache.Add(c, &memcache.Item{
+		Key:        successorCacheKey(tokenKey),
+		Value:      []byte(nextSecret),
+		Expiration: TokenRotationGrace,
+	})
+	if err != nil && err != memcache.ErrNotStored {
+		log.Warningf(c, "caching successor token: %v", err)
+	}
+	return rotated, successor, nil
+}
+
+// successorCacheWait is how long after a successor is created parallel
+// rotations wait for its secret to be cached
+const successorCacheWait = time.Second
+
+// awaitSuccessorSecret returns the cached secret of the token's successor. A
+// successor that was just created by a parallel rotation may not be cached yet,
+// so the cache is checked until successorCacheWait has passed.
+func (s *TokenStore) awaitSuccessorSecret(c context.Context, tokenKey *datastore.Key, successor *Token) string {
+	for {
+		secret := s.successorSecret(c, tokenKey, successor.Key)
+		if len(secret) > 0 || time.Since(successor.IssuedAt) > successorCacheWait {
+			return secret
+		}
+		time.Sleep(successorCacheWait / 20)
+	}
+}
+
+// SuccessorValue returns the value of the token's successor while it is
+// within the rotation grace period, or blank once it is no longer known
+func (s *TokenStore) SuccessorValue(c context.Context, tokenKey, successorKey *datastore.Key) string {
+	secret := s.successorSecret(c, tokenKey, successorKey)
+	if len(secret) == 0 {
+		return ""
+	}
+	return tokenValue(successorKey.Parent(), secret)
+}
+
+// successorSecret returns the cached secret of the token's successor, or blank
+// if it has expired or doesn't match the successor
+func (s *TokenStore) successorSecret(c context.Context, tokenKey, successorKey *datastore.Key) string {
+	item, err := memcache.Get(c, successorCacheKey(tokenKey))
+	if err != nil {
+		return ""
+	}
+	secret := string(item.Value)
+	if successorKey.StringID() != tokenDigest(secret) {
+		return ""
+	}
+	return secret
+}
+
+// Revoke deletes the token and its cached details so it can no longer be used.
+// The successors of rotated tokens are revoked along with them, so the old
+// value can't be exchanged for its successor during the grace period.
+func (s *TokenStore) Revoke(c context.Context, tokenKey *datastore.Key) error {
+	keys, err := s.withSuccessors(c, []*datastore.Key{tokenKey})
+	if err != nil {
+		return err
+	}
+	return s.revoke(c, keys)
+}
+
+// RevokeAll deletes all of the account's tokens and their cached details
+func (s *TokenStore) RevokeAll(c context.Context, accountKey *datastore.Key) error {
+	keys, err := datastore.NewQuery(s.TableName).
+		Ancestor(accountKey).
+		KeysOnly().
+		GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	return s.revoke(c, keys)
+}
+
+// withSuccessors returns the keys along with the keys of their successors, and
+// the successors' successors, ignoring tokens that don't exist
+func (s *TokenStore) withSuccessors(c context.Context, keys []*datastore.Key) ([]*datastore.Key, error) {
+	all := keys
+	for len(keys) > 0 {
+		tokens := make([]Token, len(keys))
+		err := datastore.GetMulti(c, keys, tokens)
+		errs, _ := err.(appengine.MultiError)
+		if err != nil && errs == nil {
+			return nil, err
+		}
+
+		var successors []*datastore.Key
+		for i, token := range tokens {
+			if errs != nil && errs[i] == datastore.ErrNoSuchEntity {
+				continue
+			}
+			if errs != nil && errs[i] != nil {
+				return nil, errs[i]
+			}
+			if token.Successor != nil {
+				successors = append(successors, token.Successor)
+			}
+		}
+		all = append(all, successors...)
+		keys = successors
+	}
+	return all, nil
+}
+
+func (s *TokenStore) revoke(c context.Context, keys []*datastore.Key) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	err := datastore.DeleteMulti(c, keys)
+	if err != nil {
+		return err
+	}
+
+	var cacheKeys []string
+	for _, key := range keys {
+		cacheKeys = append(cacheKeys, TokenCacheKey(key), successorCacheKey(key))
+	}
+	return deleteCache(c, cacheKeys)
+}
+
+// deleteCache removes the memcache items, ignoring any that don't exist
+func deleteCache(c context.Context, keys []string) error {
+	err := memcache.DeleteMulti(c, keys)
+	if merr, ok := err.(appengine.MultiError); ok {
+		for _, e := range merr {
+			if e != nil && e != memcache.ErrCacheMiss {
+				return e
+			}
+		}
+		return nil
+	}
+	return err
+}
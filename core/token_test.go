@@ -0,0 +1,314 @@
+package core
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestTokenStore_Revoke(t *testing.T) {
+	c := getContext()
+	store := NewTokenStore()
+	accountKey := datastore.NewKey(c, "accounts", "revoke", 0, nil)
+
+	token, err := store.Create(c, accountKey, Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := store.Create(c, accountKey, Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	memcache.Set(c, &memcache.Item{Key: TokenCacheKey(token.Key), Value: []byte("{}")})
+
+	if err = store.Revoke(c, token.Key); err != nil {
+		t.Fatal(err)
+	}
+
+	var t1 Token
+	if err = datastore.Get(c, token.Key, &t1); err != datastore.ErrNoSuchEntity {
+		t.Errorf("expected token to be deleted, got %v", err)
+	}
+	if _, err = memcache.Get(c, TokenCacheKey(token.Key)); err != memcache.ErrCacheMiss {
+		t.Errorf("expected cached token to be deleted, got %v", err)
+	}
+	if err = datastore.Get(c, other.Key, &t1); err != nil {
+		t.Errorf("expected other token to remain: %v", err)
+	}
+}
+
+func TestTokenStore_RevokeRotated(t *testing.T) {
+	c := getContext()
+	store := NewTokenStore()
+	accountKey := datastore.NewKey(c, "accounts", "revokeRotated", 0, nil)
+
+	token, err := store.Create(c, accountKey, Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, successor, err := store.Rotate(c, token.Key, Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = store.Revoke(c, token.Key); err != nil {
+		t.Fatal(err)
+	}
+
+	var t1 Token
+	if err = datastore.Get(c, successor.Key, &t1); err != datastore.ErrNoSuchEntity {
+		t.Errorf("expected successor to be revoked, got %v", err)
+	}
+	if len(store.SuccessorValue(c, token.Key, successor.Key)) > 0 {
+		t.Error("expected the successor value to be forgotten")
+	}
+}
+
+func TestTokenStore_RevokeAll(t *testing.T) {
+	c := getContext()
+	store := NewTokenStore()
+	accountKey := datastore.NewKey(c, "accounts", "revoke-all", 0, nil)
+
+	var keys []*datastore.Key
+	for i := 0; i < 3; i++ {
+		token, err := store.Create(c, accountKey, Device{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, token.Key)
+	}
+
+	if err := store.RevokeAll(c, accountKey); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range keys {
+		var token Token
+		if err := datastore.Get(c, key, &token); err != datastore.ErrNoSuchEntity {
+			t.Errorf("expected token %v to be deleted, got %v", key, err)
+		}
+	}
+}
+
+func TestTokenStore_Sessions(t *testing.T) {
+	c := getContext()
+	store := NewTokenStore()
+	accountKey := datastore.NewKey(c, "accounts", "sessions", 0, nil)
+
+	device := Device{UserAgent: "test-agent", IP: "127.0.0.1"}
+	token, err := store.Create(c, accountKey, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := store.GetByAccount(c, accountKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 {
+		t.Fatalf("expected 1 token, got %d", len(tokens))
+	}
+	if tokens[0].UserAgent != device.UserAgent || tokens[0].IP != device.IP || tokens[0].IssuedAt.IsZero() {
+		t.Errorf("device details not saved: %+v", tokens[0])
+	}
+	if tokens[0].ID() != token.ID() {
+		t.Errorf("expected id %s, got %s", token.ID(), tokens[0].ID())
+	}
+
+	key, err := store.KeyFromID(c, accountKey, token.ID())
+	if err != nil || !key.Equal(token.Key) {
+		t.Errorf("expected key from id to match token key: %v", err)
+	}
+
+	usedAt := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err = store.Touch(c, token.Key, usedAt); err != nil {
+		t.Fatal(err)
+	}
+	var touched Token
+	if err = datastore.Get(c, token.Key, &touched); err != nil {
+		t.Fatal(err)
+	}
+	if !touched.LastUsedAt.Equal(usedAt) {
+		t.Errorf("expected last used %v, got %v", usedAt, touched.LastUsedAt)
+	}
+
+	// revoked tokens must not be recreated
+	store.Revoke(c, token.Key)
+	if err = store.Touch(c, token.Key, usedAt); err != datastore.ErrNoSuchEntity {
+		t.Errorf("expected revoked token to not be touched, got %v", err)
+	}
+}
+
+func TestTokenStore_Rotate(t *testing.T) {
+	c := getContext()
+	store := NewTokenStore()
+	accountKey := datastore.NewKey(c, "accounts", "rotate", 0, nil)
+
+	token, err := store.Create(c, accountKey, Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, successor, err := store.Rotate(c, token.Key, Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if successor.Key.Equal(token.Key) {
+		t.Fatal("expected a new token")
+	}
+	if !successor.Key.Parent().Equal(accountKey) {
+		t.Error("expected successor to belong to the same account")
+	}
+	if rotated.Expiry.After(time.Now().Add(TokenRotationGrace)) {
+		t.Errorf("expected rotated token to expire within the grace period, got %v", rotated.Expiry)
+	}
+
+	// rotating again must return the same successor
+	_, again, err := store.Rotate(c, token.Key, Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Key.Equal(successor.Key) {
+		t.Errorf("expected successor %v, got %v", successor.Key, again.Key)
+	}
+	if again.Value() != successor.Value() || again.Value() != store.SuccessorValue(c, token.Key, successor.Key) {
+		t.Error("expected repeated rotations to return the same successor value")
+	}
+
+	// the successor's value is forgotten after the grace period
+	if err = memcache.Delete(c, successorCacheKey(token.Key)); err != nil {
+		t.Fatal(err)
+	}
+	_, again, err = store.Rotate(c, token.Key, Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Key.Equal(successor.Key) || len(again.Value()) > 0 {
+		t.Error("expected the successor value to no longer be known")
+	}
+
+	tokens, err := store.GetByAccount(c, accountKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 {
+		t.Errorf("expected 2 tokens, got %d", len(tokens))
+	}
+}
+
+func TestTokenStore_RotateParallel(t *testing.T) {
+	c := getContext()
+	store := NewTokenStore()
+	accountKey := datastore.NewKey(c, "accounts", "rotateParallel", 0, nil)
+
+	token, err := store.Create(c, accountKey, Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		successor *Token
+		err       error
+	}
+	results := make(chan result, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, successor, err := store.Rotate(c, token.Key, Device{})
+			results <- result{successor, err}
+		}()
+	}
+
+	first, second := <-results, <-results
+	if first.err != nil || second.err != nil {
+		t.Fatalf("expected both rotations to succeed, got %v and %v", first.err, second.err)
+	}
+	if !first.successor.Key.Equal(second.successor.Key) {
+		t.Errorf("expected the same successor, got %v and %v", first.successor.Key, second.successor.Key)
+	}
+	if len(first.successor.Value()) == 0 || first.successor.Value() != second.successor.Value() {
+		t.Error("expected parallel rotations to return the same successor value")
+	}
+	if store.SuccessorValue(c, token.Key, first.successor.Key) != first.successor.Value() {
+		t.Error("expected the cached successor value to match the saved successor")
+	}
+}
+
+func TestTokenStore_HashedValue(t *testing.T) {
+	c := getContext()
+	store := NewTokenStore()
+	accountKey := datastore.NewKey(c, "accounts", "hashed", 0, nil)
+
+	token, err := store.Create(c, accountKey, Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := token.Value()
+	if strings.Contains(token.Key.Encode(), token.secret) || token.Key.StringID() == token.secret {
+		t.Error("token secret must not be saved")
+	}
+
+	key, secret, err := ParseToken(c, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equal(token.Key) || secret != token.secret {
+		t.Errorf("parsed token doesn't match created token")
+	}
+
+	var saved Token
+	if err = datastore.Get(c, key, &saved); err != nil {
+		t.Fatal(err)
+	}
+	saved.Key = key
+	if len(saved.Value()) > 0 {
+		t.Error("loaded tokens must not have a value")
+	}
+
+	// the token key alone must not authenticate
+	if _, _, err = ParseToken(c, token.Key.Encode()); err != ErrInvalidToken {
+		t.Errorf("expected encoded key to be rejected, got %v", err)
+	}
+
+	// guessed secrets resolve to tokens that don't exist
+	key, _, err = ParseToken(c, accountKey.Encode()+".guess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = datastore.Get(c, key, &saved); err != datastore.ErrNoSuchEntity {
+		t.Errorf("expected guessed token to not exist, got %v", err)
+	}
+}
+
+func TestTokenStore_LegacyToken(t *testing.T) {
+	c := getContext()
+	store := NewTokenStore()
+	accountKey := datastore.NewKey(c, "accounts", "legacy", 0, nil)
+
+	legacyKey, err := datastore.Put(c, datastore.NewIncompleteKey(c, "tokens", accountKey), &Token{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, secret, err := ParseToken(c, legacyKey.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equal(legacyKey) {
+		t.Error("expected legacy value to resolve to its key")
+	}
+
+	_, successor, err := store.Rotate(c, key, Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if successor.IsLegacy() || len(successor.Value()) == 0 {
+		t.Error("expected legacy token to be replaced with a hashed token")
+	}
+	if strings.Contains(successor.Value(), secret) {
+		t.Error("legacy successor values must not be derived from the legacy value")
+	}
+}
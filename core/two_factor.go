@@ -0,0 +1,307 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"strings"
+	"time"
+
+	"github.com/chrisolsen/ae/model"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	twoFactorTable = "twoFactors"
+	// accounts have a single TOTP factor, so its key name is fixed
+	totpKeyName = "totp"
+
+	recoveryCodeCount = 10
+	// failed codes allowed per challenge before it is discarded
+	maxChallengeAttempts = 5
+)
+
+// TwoFactorChallengeTTL is how long a challenge can be exchanged for a token
+var TwoFactorChallengeTTL = time.Minute * 5
+
+// Two-factor errors
+var (
+	ErrInvalidTwoFactorCode = NewError(Invalid, "invalid_two_factor_code", "invalid two-factor code")
+	ErrTwoFactorEnabled     = NewError(Conflict, "two_factor_enabled", "two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled  = NewError(Conflict, "two_factor_not_enabled", "two-factor authentication is not enabled")
+	ErrInvalidChallenge     = NewError(Unauthorized, "invalid_challenge", "invalid or expired two-factor challenge")
+)
+
+// SecondFactorRequired is returned in place of a token when the credentials
+// are valid but the account has two-factor authentication enabled. The
+// challenge is exchanged for a token along with a code.
+type SecondFactorRequired struct {
+	Challenge string
+	Expiry    time.Time
+}
+
+func (e *SecondFactorRequired) Error() string {
+	return "second factor required"
+}
+
+// TwoFactor is an account's TOTP second factor. It is saved when enrollment
+// starts and is enabled once the first code is confirmed.
+type TwoFactor struct {
+	model.Base
+	Secret  string    `json:"-" datastore:",noindex"`
+	Enabled time.Time `json:"enabled" datastore:",noindex"`
+	// digests of the unused recovery codes
+	RecoveryCodes []string `json:"-" datastore:",noindex"`
+	// time step of the last accepted code, which prevents codes being replayed
+	LastCounter int64 `json:"-" datastore:",noindex"`
+}
+
+// IsEnabled indicates if codes are required to authenticate
+func (t *TwoFactor) IsEnabled() bool {
+	return !t.Enabled.IsZero()
+}
+
+// Enrollment contains the details added to the user's authenticator app
+type Enrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// TwoFactorService manages accounts' TOTP second factors
+type TwoFactorService struct {
+	// Issuer is the name authenticator apps list the account under
+	Issuer string
+	Clock  Clock
+	// Throttle limits invalid codes per account when disabling the factor or
+	// replacing its recovery codes
+	Throttle *LoginThrottle
+}
+
+// Enabled indicates if the account requires a second factor
+func (s *TwoFactorService) Enabled(c context.Context, accountKey *datastore.Key) (bool, error) {
+	tf, err := s.get(c, accountKey)
+	if err == datastore.ErrNoSuchEntity {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return tf.IsEnabled(), nil
+}
+
+// Enroll creates a new secret for the account, replacing any unconfirmed
+// enrollment. The name identifies the account within authenticator apps.
+func (s *TwoFactorService) Enroll(c context.Context, accountKey *datastore.Key, name string) (*Enrollment, error) {
+	var secret string
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		tf, err := s.get(tc, accountKey)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if err == nil && tf.IsEnabled() {
+			return ErrTwoFactorEnabled
+		}
+
+		secret, err = newTOTPSecret()
+		if err != nil {
+			return err
+		}
+		_, err = datastore.Put(tc, s.key(tc, accountKey), &TwoFactor{Secret: secret})
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Enrollment{
+		Secret: secret,
+		URI:    totpURI(s.Issuer, name, secret),
+	}, nil
+}
+
+// Confirm enables the enrolled second factor once the first code is valid and
+// returns the recovery codes. The codes are only available at this point.
+func (s *TwoFactorService) Confirm(c context.Context, accountKey *datastore.Key, code string) ([]string, error) {
+	var codes []string
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		tf, err := s.get(tc, accountKey)
+		if err == datastore.ErrNoSuchEntity {
+			return ErrTwoFactorNotEnabled
+		}
+		if err != nil {
+			return err
+		}
+		if tf.IsEnabled() {
+			return ErrTwoFactorEnabled
+		}
+
+		counter, ok := totpMatch(tf.Secret, code, s.Clock.Now(), tf.LastCounter)
+		if !ok {
+			return ErrInvalidTwoFactorCode
+		}
+
+		codes, tf.RecoveryCodes, err = newRecoveryCodes()
+		if err != nil {
+			return err
+		}
+		tf.LastCounter = counter
+		tf.Enabled = s.Clock.Now()
+		_, err = datastore.Put(tc, tf.Key, tf)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Disable removes the second factor after validating the code or recovery code
+func (s *TwoFactorService) Disable(c context.Context, accountKey *datastore.Key, code string) error {
+	return s.throttle(c, accountKey, func() error {
+		return datastore.RunInTransaction(c, func(tc context.Context) error {
+			tf, err := s.validate(tc, accountKey, code)
+			if err != nil {
+				return err
+			}
+			return datastore.Delete(tc, tf.Key)
+		}, nil)
+	})
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes after validating the code
+func (s *TwoFactorService) RegenerateRecoveryCodes(c context.Context, accountKey *datastore.Key, code string) ([]string, error) {
+	var codes []string
+	err := s.throttle(c, accountKey, func() error {
+		return datastore.RunInTransaction(c, func(tc context.Context) error {
+			tf, err := s.validate(tc, accountKey, code)
+			if err != nil {
+				return err
+			}
+			codes, tf.RecoveryCodes, err = newRecoveryCodes()
+			if err != nil {
+				return err
+			}
+			_, err = datastore.Put(tc, tf.Key, tf)
+			return err
+		}, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Validate checks the TOTP or recovery code for the account. Each code can only
+// be used once.
+func (s *TwoFactorService) Validate(c context.Context, accountKey *datastore.Key, code string) error {
+	return datastore.RunInTransaction(c, func(tc context.Context) error {
+		_, err := s.validate(tc, accountKey, code)
+		return err
+	}, nil)
+}
+
+// throttle runs the code check unless the account is throttled, recording the
+// invalid codes. Errors saving the attempts are only logged so the original
+// result is returned.
+func (s *TwoFactorService) throttle(c context.Context, accountKey *datastore.Key, check func() error) error {
+	key := AccountThrottleKey(accountKey)
+	err := s.Throttle.Check(c, key)
+	if err != nil {
+		return err
+	}
+
+	err = check()
+	if err == ErrInvalidTwoFactorCode {
+		if ferr := s.Throttle.Fail(c, key); ferr != nil {
+			log.Warningf(c, "recording failed attempt: %v", ferr)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if rerr := s.Throttle.Reset(c, key); rerr != nil {
+		log.Warningf(c, "resetting failed attempts: %v", rerr)
+	}
+	return nil
+}
+
+// validate checks the code and saves the factor so the code can't be reused;
+// must be called within a transaction
+func (s *TwoFactorService) validate(c context.Context, accountKey *datastore.Key, code string) (*TwoFactor, error) {
+	tf, err := s.get(c, accountKey)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrTwoFactorNotEnabled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !tf.IsEnabled() {
+		return nil, ErrTwoFactorNotEnabled
+	}
+
+	if counter, ok := totpMatch(tf.Secret, code, s.Clock.Now(), tf.LastCounter); ok {
+		tf.LastCounter = counter
+	} else if i := matchRecoveryCode(tf.RecoveryCodes, code); i >= 0 {
+		tf.RecoveryCodes = append(tf.RecoveryCodes[:i], tf.RecoveryCodes[i+1:]...)
+	} else {
+		return nil, ErrInvalidTwoFactorCode
+	}
+
+	_, err = datastore.Put(c, tf.Key, tf)
+	if err != nil {
+		return nil, err
+	}
+	return tf, nil
+}
+
+func (s *TwoFactorService) key(c context.Context, accountKey *datastore.Key) *datastore.Key {
+	return datastore.NewKey(c, twoFactorTable, totpKeyName, 0, accountKey)
+}
+
+func (s *TwoFactorService) get(c context.Context, accountKey *datastore.Key) (*TwoFactor, error) {
+	var tf TwoFactor
+	key := s.key(c, accountKey)
+	err := datastore.Get(c, key, &tf)
+	if err != nil {
+		return nil, err
+	}
+	tf.Key = key
+	return &tf, nil
+}
+
+// newRecoveryCodes returns the codes given to the user along with the digests
+// that are saved
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	digests := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+		digests[i] = tokenDigest(normalizeRecoveryCode(code))
+	}
+	return codes, digests, nil
+}
+
+// matchRecoveryCode returns the index of the code's digest, or -1
+func matchRecoveryCode(digests []string, code string) int {
+	digest := tokenDigest(normalizeRecoveryCode(code))
+	for i, d := range digests {
+		if subtle.ConstantTimeCompare([]byte(d), []byte(digest)) == 1 {
+			return i
+		}
+	}
+	return -1
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.Replace(code, "-", "", -1)
+	code = strings.Replace(code, " ", "", -1)
+	return strings.ToLower(code)
+}
@@ -0,0 +1,180 @@
+package core
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, truncated to 6 digits
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	tests := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, expected := range tests {
+		code, err := totpCode(secret, totpCounter(time.Unix(unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != expected {
+			t.Errorf("%d: expected %s, got %s", unix, expected, code)
+		}
+	}
+}
+
+func TestTwoFactorService_Authenticate(t *testing.T) {
+	c := getContext()
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	twoFactor := TwoFactorService{Issuer: "Example", Clock: func() time.Time { return now }}
+	svc := AuthService{TwoFactor: twoFactor}
+
+	accountKey, err := datastore.Put(c, datastore.NewIncompleteKey(c, "accounts", nil), &Account{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cstore := NewCredentialStore()
+	if _, err = cstore.Create(c, &Credentials{Username: "two-factor", Password: "foobario"}, accountKey); err != nil {
+		t.Fatal(err)
+	}
+
+	enrollment, err := twoFactor.Enroll(c, accountKey, "two-factor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/Example:two-factor?") {
+		t.Errorf("unexpected uri: %s", enrollment.URI)
+	}
+
+	// not required until confirmed
+	if _, err = svc.Authenticate(c, &Credentials{Username: "two-factor", Password: "foobario"}); err != nil {
+		t.Fatal(err)
+	}
+
+	code, _ := totpCode(enrollment.Secret, totpCounter(now))
+	recoveryCodes, err := twoFactor.Confirm(c, accountKey, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recoveryCodes) != recoveryCodeCount {
+		t.Errorf("expected %d recovery codes, got %d", recoveryCodeCount, len(recoveryCodes))
+	}
+
+	_, err = svc.Authenticate(c, &Credentials{Username: "two-factor", Password: "foobario"})
+	challenge, ok := err.(*SecondFactorRequired)
+	if !ok {
+		t.Fatalf("expected second factor to be required, got %v", err)
+	}
+
+	if _, err = svc.CompleteTwoFactor(c, challenge.Challenge, "000000"); err != ErrInvalidTwoFactorCode {
+		t.Errorf("expected invalid code to be rejected, got %v", err)
+	}
+	// codes can't be replayed within their time step
+	if _, err = svc.CompleteTwoFactor(c, challenge.Challenge, code); err != ErrInvalidTwoFactorCode {
+		t.Errorf("expected confirmation code to be rejected, got %v", err)
+	}
+
+	now = now.Add(time.Second * totpPeriod)
+	code, _ = totpCode(enrollment.Secret, totpCounter(now))
+	token, err := svc.CompleteTwoFactor(c, challenge.Challenge, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !token.Key.Parent().Equal(accountKey) {
+		t.Error("expected token for the account")
+	}
+
+	// challenges are single use
+	now = now.Add(time.Second * totpPeriod)
+	code, _ = totpCode(enrollment.Secret, totpCounter(now))
+	if _, err = svc.CompleteTwoFactor(c, challenge.Challenge, code); err != ErrInvalidChallenge {
+		t.Errorf("expected used challenge to be rejected, got %v", err)
+	}
+
+	// recovery codes are single use
+	if err = twoFactor.Validate(c, accountKey, strings.ToUpper(recoveryCodes[0])); err != nil {
+		t.Errorf("expected recovery code to be accepted: %v", err)
+	}
+	if err = twoFactor.Validate(c, accountKey, recoveryCodes[0]); err != ErrInvalidTwoFactorCode {
+		t.Errorf("expected used recovery code to be rejected, got %v", err)
+	}
+}
+
+func TestTwoFactorService_ChallengeAttempts(t *testing.T) {
+	c := getContext()
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	twoFactor := TwoFactorService{Clock: func() time.Time { return now }}
+	svc := AuthService{TwoFactor: twoFactor}
+	accountKey := datastore.NewKey(c, "accounts", "attempts", 0, nil)
+
+	enrollment, err := twoFactor.Enroll(c, accountKey, "attempts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := totpCode(enrollment.Secret, totpCounter(now))
+	if _, err = twoFactor.Confirm(c, accountKey, code); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = twoFactor.Enroll(c, accountKey, "attempts"); err != ErrTwoFactorEnabled {
+		t.Errorf("expected enrollment to be rejected once enabled, got %v", err)
+	}
+
+	challenge := svc.challenge(c, accountKey).(*SecondFactorRequired)
+	for i := 0; i < maxChallengeAttempts; i++ {
+		if _, err = svc.CompleteTwoFactor(c, challenge.Challenge, "000000"); err != ErrInvalidTwoFactorCode {
+			t.Fatalf("expected invalid code to be rejected, got %v", err)
+		}
+	}
+
+	now = now.Add(time.Second * totpPeriod)
+	code, _ = totpCode(enrollment.Secret, totpCounter(now))
+	if _, err = svc.CompleteTwoFactor(c, challenge.Challenge, code); err != ErrInvalidChallenge {
+		t.Errorf("expected challenge to be discarded after too many attempts, got %v", err)
+	}
+}
+
+func TestTwoFactorService_DisableThrottle(t *testing.T) {
+	c := getContext()
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	throttle := &LoginThrottle{FreeAttempts: 2, BaseDelay: time.Minute, Clock: clock}
+	twoFactor := TwoFactorService{Clock: clock, Throttle: throttle}
+	accountKey := datastore.NewKey(c, "accounts", "disable-throttle", 0, nil)
+
+	enrollment, err := twoFactor.Enroll(c, accountKey, "disable-throttle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := totpCode(enrollment.Secret, totpCounter(now))
+	if _, err = twoFactor.Confirm(c, accountKey, code); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err = twoFactor.Disable(c, accountKey, "000000"); err != ErrInvalidTwoFactorCode {
+			t.Fatalf("expected invalid code to be rejected, got %v", err)
+		}
+	}
+	if err = twoFactor.Disable(c, accountKey, "000000"); err != ErrInvalidTwoFactorCode {
+		t.Fatalf("expected invalid code to be rejected, got %v", err)
+	}
+
+	// further codes are blocked, even valid ones
+	now = now.Add(time.Second * totpPeriod)
+	code, _ = totpCode(enrollment.Secret, totpCounter(now))
+	if err = twoFactor.Disable(c, accountKey, code); err == nil {
+		t.Fatal("expected attempt to be throttled")
+	} else if _, ok := err.(*ThrottledError); !ok {
+		t.Fatalf("expected throttled error, got %v", err)
+	}
+	if _, err = twoFactor.RegenerateRecoveryCodes(c, accountKey, code); err == nil {
+		t.Fatal("expected attempt to be throttled")
+	} else if _, ok := err.(*ThrottledError); !ok {
+		t.Fatalf("expected throttled error, got %v", err)
+	}
+}
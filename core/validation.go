@@ -0,0 +1,147 @@
+package core
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Field length limits
+const (
+	MaxNameLength     = 100
+	MaxLocationLength = 200
+	MaxEmailLength    = 254
+	MaxUsernameLength = 254
+	// bcrypt ignores anything past 72 bytes
+	MaxPasswordLength = 72
+
+	maxProviderNameLength  = 50
+	maxProviderValueLength = 4096
+)
+
+// Genders are the accepted account genders; blank is left unspecified
+var Genders = []string{"female", "male", "other"}
+
+// matches well-formed BCP 47 language tags: language[-script][-region][-variant]...
+var localePattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z]{4})?(-([a-zA-Z]{2}|[0-9]{3}))?(-([a-zA-Z0-9]{5,8}|[0-9][a-zA-Z0-9]{3}))*$`)
+
+// Validator is implemented by payloads that check their own fields. Validate
+// returns an Invalid *Error listing each invalid field.
+type Validator interface {
+	Validate() error
+}
+
+// ValidateAll validates each of the named payloads and returns a single error
+// with all of their invalid fields, each prefixed with its payload's name
+func ValidateAll(payloads map[string]Validator) error {
+	var names []string
+	for name := range payloads {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	v := validator{}
+	for _, name := range names {
+		err := payloads[name].Validate()
+		if err == nil {
+			continue
+		}
+		e, ok := err.(*Error)
+		if !ok || len(e.Fields) == 0 {
+			return err
+		}
+		for _, f := range e.Fields {
+			v.add(name+"."+f.Field, f.Code, f.Message)
+		}
+	}
+	return v.err()
+}
+
+// NormalizeEmail trims the email and lower cases its domain; the local part is
+// left as is since it may be case sensitive
+func NormalizeEmail(email string) string {
+	email = strings.TrimSpace(email)
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+	return email[:at] + strings.ToLower(email[at:])
+}
+
+// validator collects the invalid fields of a payload
+type validator struct {
+	fields []FieldError
+}
+
+func (v *validator) add(field, code, message string) {
+	v.fields = append(v.fields, FieldError{Field: field, Code: code, Message: message})
+}
+
+func (v *validator) maxLength(field, value string, max int) bool {
+	if utf8.RuneCountInString(value) > max {
+		v.add(field, "too_long", fmt.Sprintf("%s can't be longer than %d characters", field, max))
+		return false
+	}
+	return true
+}
+
+func (v *validator) password(field, value string) {
+	if len(value) > MaxPasswordLength {
+		v.add(field, "too_long", fmt.Sprintf("%s can't be longer than %d bytes", field, MaxPasswordLength))
+	}
+}
+
+func (v *validator) email(field, value string) {
+	if !v.maxLength(field, value, MaxEmailLength) {
+		return
+	}
+	addr, err := mail.ParseAddress(value)
+	if err != nil || addr.Address != value || len(addr.Name) > 0 || !strings.Contains(value[strings.LastIndex(value, "@"):], ".") {
+		v.add(field, "invalid_email", fmt.Sprintf("%s is not a valid email address", field))
+	}
+}
+
+func (v *validator) timezone(field, value string) {
+	// LoadLocation accepts "Local", which depends on the server's zone
+	_, err := time.LoadLocation(value)
+	if err != nil || value == "Local" {
+		v.add(field, "invalid_timezone", fmt.Sprintf("%s must be an IANA time zone, such as America/Edmonton", field))
+	}
+}
+
+func (v *validator) locale(field, value string) {
+	if !localePattern.MatchString(value) {
+		v.add(field, "invalid_locale", fmt.Sprintf("%s must be a BCP 47 language tag, such as en-CA", field))
+	}
+}
+
+func (v *validator) oneOf(field, value string, values []string) {
+	for _, val := range values {
+		if value == val {
+			return
+		}
+	}
+	v.add(field, "invalid_value", fmt.Sprintf("%s must be one of: %s", field, strings.Join(values, ", ")))
+}
+
+// err returns the Invalid error listing the collected fields, if any
+func (v *validator) err() error {
+	if len(v.fields) == 0 {
+		return nil
+	}
+	return InvalidFields(v.fields...)
+}
+
+// InvalidFields returns the Invalid error listing the fields
+func InvalidFields(fields ...FieldError) error {
+	return &Error{
+		Kind:    Invalid,
+		Code:    "invalid_fields",
+		Message: "one or more fields are invalid",
+		Fields:  fields,
+	}
+}
@@ -0,0 +1,123 @@
+package core
+
+import (
+	"strings"
+	"testing"
+
+	"google.golang.org/appengine/datastore"
+)
+
+func TestAccount_Validate(t *testing.T) {
+	type data struct {
+		name    string
+		account *Account
+		fields  []string
+	}
+
+	tests := []data{
+		data{name: "empty", account: &Account{}},
+		data{name: "valid", account: &Account{Email: "bob@example.com", Gender: "male", Locale: "en-CA", Timezone: "America/Edmonton"}},
+		data{name: "script and region", account: &Account{Locale: "zh-Hant-TW"}},
+		data{name: "invalid email", account: &Account{Email: "bob@"}, fields: []string{"email"}},
+		data{name: "named email", account: &Account{Email: "Bob <bob@example.com>"}, fields: []string{"email"}},
+		data{name: "email without domain", account: &Account{Email: "bob@localhost"}, fields: []string{"email"}},
+		data{name: "unknown gender", account: &Account{Gender: "unknown"}, fields: []string{"gender"}},
+		data{name: "invalid locale", account: &Account{Locale: "en_CA"}, fields: []string{"locale"}},
+		data{name: "offset timezone", account: &Account{Timezone: "-7"}, fields: []string{"timezone"}},
+		data{name: "local timezone", account: &Account{Timezone: "Local"}, fields: []string{"timezone"}},
+		data{name: "long name", account: &Account{FirstName: strings.Repeat("a", MaxNameLength+1)}, fields: []string{"firstName"}},
+		data{name: "multiple", account: &Account{Email: "bob", Locale: "english"}, fields: []string{"email", "locale"}},
+	}
+
+	for _, test := range tests {
+		var fields []string
+		for _, f := range FieldsOf(test.account.Validate()) {
+			fields = append(fields, f.Field)
+		}
+		if strings.Join(fields, ",") != strings.Join(test.fields, ",") {
+			t.Errorf("%s: expected invalid fields %v, got %v", test.name, test.fields, fields)
+		}
+	}
+}
+
+func TestAccount_ValidateNormalizes(t *testing.T) {
+	account := Account{FirstName: " Bob ", Email: " Bob@Example.COM "}
+	if err := account.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if account.FirstName != "Bob" {
+		t.Errorf("expected first name to be trimmed, got %q", account.FirstName)
+	}
+	if account.Email != "Bob@example.com" {
+		t.Errorf("expected email domain to be lower cased, got %q", account.Email)
+	}
+}
+
+func TestAccount_LoadLegacyTimezone(t *testing.T) {
+	c := getContext()
+
+	// accounts used to save the timezone as an offset
+	type legacyAccount struct {
+		FirstName string
+		Timezone  int
+	}
+	key := datastore.NewIncompleteKey(c, accountsTable, nil)
+	key, err := datastore.Put(c, key, &legacyAccount{FirstName: "bob", Timezone: -7})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var account Account
+	if err = datastore.Get(c, key, &account); err != nil {
+		t.Fatal(err)
+	}
+	if account.FirstName != "bob" || account.Timezone != "Etc/GMT+7" {
+		t.Errorf("expected legacy timezone to be converted, got %+v", account)
+	}
+	if err = account.Validate(); err != nil {
+		t.Errorf("expected converted timezone to be valid, got %v", err)
+	}
+
+	// kept when the account is saved again
+	if _, err = datastore.Put(c, key, &account); err != nil {
+		t.Fatal(err)
+	}
+	account = Account{}
+	if err = datastore.Get(c, key, &account); err != nil {
+		t.Fatal(err)
+	}
+	if account.Timezone != "Etc/GMT+7" {
+		t.Errorf("expected converted timezone to be saved, got %q", account.Timezone)
+	}
+}
+
+func TestCredentials_Validate(t *testing.T) {
+	err := (&Credentials{}).Validate()
+	if err != ErrMissingCredentials {
+		t.Errorf("expected missing credentials, got %v", err)
+	}
+
+	creds := Credentials{Username: " bob ", Password: strings.Repeat("a", MaxPasswordLength+1)}
+	fields := FieldsOf(creds.Validate())
+	if len(fields) != 1 || fields[0].Field != "password" {
+		t.Errorf("expected long password to be invalid, got %v", fields)
+	}
+	if creds.Username != "bob" {
+		t.Errorf("expected username to be trimmed, got %q", creds.Username)
+	}
+}
+
+func TestValidateAll(t *testing.T) {
+	err := ValidateAll(map[string]Validator{
+		"account":     &Account{Gender: "unknown"},
+		"credentials": &Credentials{Username: strings.Repeat("a", MaxUsernameLength+1), Password: "foobario"},
+	})
+	if KindOf(err) != Invalid {
+		t.Fatalf("expected invalid error, got %v", err)
+	}
+
+	fields := FieldsOf(err)
+	if len(fields) != 2 || fields[0].Field != "account.gender" || fields[1].Field != "credentials.username" {
+		t.Errorf("expected prefixed fields, got %v", fields)
+	}
+}